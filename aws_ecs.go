@@ -1,13 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecs"
-	"github.com/blaines/tasque-go/result"
 	"github.com/fsouza/go-dockerclient"
 	"io/ioutil"
 	"log"
@@ -23,10 +25,17 @@ type AWSECS struct {
 	overridePayloadKey    *string
 	heartbeatDuration     time.Duration
 	taskArn               string
-	handler               MessageHandler
+	handler               source.MessageHandler
 	timeout               time.Duration
+	grace                 time.Duration
 	docker                *Docker
 	result                result.Result
+	ecsClient             *ecs.ECS
+	ecsCluster            *string
+	containerID           string
+	captureMode           string
+	outputPath            string
+	output                *string
 }
 
 // Docker hello world
@@ -48,9 +57,9 @@ type ECSMetadata struct {
 	Version              string `json:"Version"`
 }
 
-func (executable AWSECS) Execute(handler MessageHandler) {
+func (executable AWSECS) Execute(ctx context.Context, handler source.MessageHandler) {
 	executable.handler = handler
-	executable.execute(handler)
+	executable.execute(ctx, handler)
 }
 
 func (executable *AWSECS) Result() result.Result {
@@ -72,7 +81,7 @@ func (ecsmeta *ECSMetadata) init() {
 	if resp.StatusCode == 200 {
 		body, _ := ioutil.ReadAll(resp.Body)
 		if err := json.Unmarshal(body, &ecsmeta); err != nil {
-			fmt.Println(string(body))
+			log.Println(string(body))
 			panic(err)
 		}
 	} else {
@@ -98,7 +107,7 @@ func (m *InstanceMetadata) init() *ec2metadata.EC2Metadata {
 			log.Printf("[INFO] Connecting metadata service (%d)", i)
 			sess, err := session.NewSession()
 			if err != nil {
-				fmt.Println("failed to create session,", err)
+				log.Println("failed to create session,", err)
 				panic("failed to create session")
 			}
 
@@ -114,50 +123,54 @@ func (m *InstanceMetadata) init() *ec2metadata.EC2Metadata {
 	}
 }
 
-func (executable AWSECS) execute(handler MessageHandler) {
-	handler.initialize()
-	if handler.receive() {
-		executable.executableTimeoutHelper(handler)
-	}
+func (executable AWSECS) execute(ctx context.Context, handler source.MessageHandler) {
+	executable.executableTimeoutHelper(ctx, handler)
 }
 
-func (executable *AWSECS) executableTimeoutHelper(handler MessageHandler) {
+func (executable *AWSECS) executableTimeoutHelper(ctx context.Context, handler source.MessageHandler) {
+	timedOut := make(chan struct{})
 	// Channel receives exit event
-	ch := make(chan error)
+	ch := make(chan error, 1)
 	go func() {
-		ch <- executable.executionHelper(handler.body(), handler.id())
+		ch <- executable.executionHelper(ctx, timedOut, handler.Body(), handler.ID(), source.TaskEnvironment(handler))
 	}()
+	// Placing the task and pulling its image take time of the message too
+	stopHeartbeat := startHeartbeat(handler, executable.heartbeatDuration)
+	var err error
 	select {
-	case err := <-ch:
-		if err != nil {
-			log.Printf("E: %s %s", *executable.ecsTaskDefinition, err.Error())
-			if strings.Contains(err.Error(), "InvalidParameterException") {
-				executable.result.SetExit("PARAMETER")
-			} else if executable.result.Exit == "" {
-				executable.result.SetExit("UNKNOWN")
-			}
-			handler.failure(executable.result)
-		} else {
-			log.Printf("I: %s finished successfully", *executable.ecsTaskDefinition)
-			handler.success()
-		}
+	case err = <-ch:
 	case <-time.After(executable.timeout):
-		err := fmt.Errorf("%s timed out after %f seconds", *executable.ecsTaskDefinition, executable.timeout.Seconds())
-		log.Println(err)
+		log.Printf("I: %s timed out, stopping task", *executable.ecsTaskDefinition)
+		// Wait until the task is stopped, so it doesn't outlive its message
+		close(timedOut)
+		<-ch
 		executable.result.SetExit("TIMEOUT")
-		handler.failure(executable.result)
+		err = fmt.Errorf("%s timed out after %f seconds", *executable.ecsTaskDefinition, executable.timeout.Seconds())
+	}
+	stopHeartbeat()
+	if err != nil {
+		log.Printf("E: %s %s", *executable.ecsTaskDefinition, err.Error())
+		if strings.Contains(err.Error(), "InvalidParameterException") {
+			executable.result.SetExit("PARAMETER")
+		} else if executable.result.Exit == "" {
+			executable.result.SetExit("UNKNOWN")
+		}
+		handler.Failure(executable.result)
+	} else {
+		log.Printf("I: %s finished successfully", *executable.ecsTaskDefinition)
+		handler.Success(executable.output)
 	}
 }
 
-func (executable *AWSECS) executionHelper(messageBody *string, messageID *string) error {
+func (executable *AWSECS) executionHelper(ctx context.Context, timedOut <-chan struct{}, messageBody *string, messageID *string, env []string) error {
 	var err error
 	var taskArn string
-	taskArn, err = executable.startECSContainer(messageBody, messageID)
+	taskArn, err = executable.startECSContainer(messageBody, messageID, env)
 	executable.taskArn = taskArn
 	if err != nil {
 		return err
 	}
-	err = executable.monitorDocker()
+	err = executable.monitorDocker(ctx, timedOut)
 	if err != nil {
 		return err
 	}
@@ -167,7 +180,7 @@ func (executable *AWSECS) executionHelper(messageBody *string, messageID *string
 //  Task ARN is part of Docker labels...
 //                 "com.amazonaws.ecs.task-arn": "arn:aws:ecs:us-west-2:770136283015:task/d8e65fde-65dc-4e46-aeaa-8b2b33215349",
 
-func (executable *AWSECS) startECSContainer(messageBody *string, messageID *string) (string, error) {
+func (executable *AWSECS) startECSContainer(messageBody *string, messageID *string, env []string) (string, error) {
 	e := &ECSMetadata{}
 	m := &InstanceMetadata{}
 	m.init()
@@ -181,11 +194,33 @@ func (executable *AWSECS) startECSContainer(messageBody *string, messageID *stri
 	// Start ECS task on self
 	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-west-2")})
 	if err != nil {
-		fmt.Println("failed to create session,", err)
+		log.Println("failed to create session,", err)
 		return "", err
 	}
 
 	svc := ecs.New(sess)
+	executable.ecsClient = svc
+	executable.ecsCluster = ecsCluster
+
+	environment := []*ecs.KeyValuePair{
+		{
+			Name:  executable.overridePayloadKey,
+			Value: aws.String(*messageBody),
+		},
+	}
+	if executable.captureMode != outputNone {
+		environment = append(environment, &ecs.KeyValuePair{
+			Name:  aws.String("TASK_OUTPUT_PATH"),
+			Value: aws.String(executable.containerOutputPath()),
+		})
+	}
+	for _, pair := range env {
+		variable := strings.SplitN(pair, "=", 2)
+		environment = append(environment, &ecs.KeyValuePair{
+			Name:  aws.String(variable[0]),
+			Value: aws.String(variable[1]),
+		})
+	}
 
 	params := &ecs.StartTaskInput{
 		ContainerInstances: []*string{
@@ -196,13 +231,8 @@ func (executable *AWSECS) startECSContainer(messageBody *string, messageID *stri
 		Overrides: &ecs.TaskOverride{
 			ContainerOverrides: []*ecs.ContainerOverride{
 				{
-					Environment: []*ecs.KeyValuePair{
-						{
-							Name:  executable.overridePayloadKey,
-							Value: aws.String(*messageBody),
-						},
-					},
-					Name: executable.overrideContainerName,
+					Environment: environment,
+					Name:        executable.overrideContainerName,
 				},
 			},
 		},
@@ -213,12 +243,12 @@ func (executable *AWSECS) startECSContainer(messageBody *string, messageID *stri
 	if err != nil {
 		// Print the error, cast err to awserr.Error to get the Code and
 		// Message from an error.
-		fmt.Println("Error:", err.Error())
+		log.Println("Error:", err.Error())
 		return "", err
 	}
 
 	// Pretty-print the response data.
-	fmt.Println(resp)
+	log.Println(resp)
 	if len(resp.Failures) > 0 {
 		var err error
 		// There were errors starting the container
@@ -249,10 +279,10 @@ func (executable *AWSECS) startECSContainer(messageBody *string, messageID *stri
 	return *taskArn, nil
 }
 
-func (executable *AWSECS) monitorDocker() error {
+func (executable *AWSECS) monitorDocker(ctx context.Context, timedOut <-chan struct{}) error {
 	executable.docker.addListener()
 	// Monitor docker events for sibling Projector task
-	status, err := executable.listenForDie()
+	status, err := executable.listenForDie(ctx, timedOut)
 	if err != nil {
 		return err
 	}
@@ -261,6 +291,9 @@ func (executable *AWSECS) monitorDocker() error {
 	if status == "0" {
 		// status is die
 		log.Printf("[INFO] Execution completed successfully")
+		if executable.containerID != "" {
+			executable.output = containerOutput(executable.docker.client, executable.containerID, executable.containerOutputPath(), executable.captureMode)
+		}
 		executable.success()
 		return nil
 	}
@@ -272,15 +305,25 @@ func (executable *AWSECS) monitorDocker() error {
 
 }
 
-func (executable *AWSECS) listenForDie() (exitCode string, err error) {
+// listenForDie waits for the task's container to exit. The task is stopped
+// once ctx is done or timedOut is closed, its exit is then SHUTDOWN or
+// TIMEOUT unless it succeeded anyway. The stopped reason tells an abandoned
+// message from a shutdown.
+func (executable *AWSECS) listenForDie(ctx context.Context, timedOut <-chan struct{}) (exitCode string, err error) {
 	log.Printf("[INFO] Monitoring Docker events.")
 	log.Printf("[DEBUG] %+v\n", executable.docker)
-	timeout := time.After(executable.timeout)
-	ticker := time.NewTicker(executable.heartbeatDuration)
-	defer func() {
-		executable.docker.removeListener()
-		ticker.Stop()
-	}()
+	shutdown := ctx.Done()
+	var stopped string
+	var grace <-chan time.Time
+	stop := func(exit string, reason string) {
+		// Stop listening on ctx and timedOut, they stay closed
+		shutdown = nil
+		timedOut = nil
+		stopped = exit
+		grace = time.After(executable.grace)
+		executable.stopTask(reason)
+	}
+	defer executable.docker.removeListener()
 	for {
 		select {
 		case msg := <-executable.docker.eventsCh:
@@ -291,36 +334,61 @@ func (executable *AWSECS) listenForDie() (exitCode string, err error) {
 					switch msg.Action {
 					case "die":
 						log.Printf("[INFO] Container die event")
-						return msg.Actor.Attributes["exitCode"], nil
+						exitCode = msg.Actor.Attributes["exitCode"]
+						if stopped != "" && exitCode != "0" {
+							return stopped, nil
+						}
+						return exitCode, nil
 					case "start":
 						log.Printf("[INFO] Container start event")
+						executable.containerID = msg.ID
 						executable.result.SetHost(msg.ID[0:12])
-						// Ticker to check docker container status
-						go func() {
-							for t := range ticker.C {
-								container, err := executable.docker.client.InspectContainer(msg.ID)
-								if err != nil {
-									log.Println(fmt.Errorf("There was an error checking container status %s", err.Error()))
-								}
-								if container.State.Running == true {
-									executable.handler.heartbeat()
-									log.Println("Heartbeat", t)
-								} else {
-									log.Printf("Container state is %s", container.State.Status)
-								}
-							}
-						}()
 					}
 				}
 			}
-		case <-timeout:
-			log.Printf("[INFO] Instance timeout reached.")
-			err := fmt.Errorf("Docker container %s timed out after %f seconds", *executable.ecsTaskDefinition, executable.timeout.Seconds())
-			return "timeout", err
+		case <-shutdown:
+			if abandoned(executable.handler) {
+				stop("SHUTDOWN", "tasque message abandoned")
+			} else {
+				stop("SHUTDOWN", "tasque worker shutting down")
+			}
+		case <-timedOut:
+			stop("TIMEOUT", "tasque task timed out")
+		case <-grace:
+			log.Printf("[ERROR] Task %s still running after %f seconds grace", executable.taskArn, executable.grace.Seconds())
+			if executable.containerID != "" {
+				err := executable.docker.client.KillContainer(docker.KillContainerOptions{ID: executable.containerID, Signal: docker.SIGKILL})
+				if err != nil {
+					log.Printf("Kill container %s (%s)", executable.containerID, err)
+				}
+			}
+			return stopped, nil
 		}
 	}
 }
 
+func (executable *AWSECS) containerOutputPath() string {
+	if executable.outputPath != "" {
+		return executable.outputPath
+	}
+	return defaultContainerOutputPath
+}
+
+// stopTask asks ECS to stop the sibling task, which sends SIGTERM to its
+// containers and SIGKILL once their stop timeout passes. reason shows up as
+// the task's stopped reason in ECS.
+func (executable *AWSECS) stopTask(reason string) {
+	log.Printf("[INFO] Stopping task %s, %s", executable.taskArn, reason)
+	_, err := executable.ecsClient.StopTask(&ecs.StopTaskInput{
+		Cluster: executable.ecsCluster,
+		Task:    aws.String(executable.taskArn),
+		Reason:  aws.String(reason),
+	})
+	if err != nil {
+		log.Printf("[ERROR] Couldn't stop task %s %s", executable.taskArn, err.Error())
+	}
+}
+
 func (dockerobj *Docker) connect(dockerEndpointPath string) {
 	log.Printf("[INFO] Connecting to Docker API.")
 	endpoint := dockerEndpointPath
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 
 	"k8s.io/apimachinery/pkg/api/resource"
 
-	"github.com/blaines/tasque-go/result"
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
 	jobsv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -19,18 +24,15 @@ import (
 
 // AWSEKS handles the EKS integration
 type AWSEKS struct {
-	DockerImage    string
-	KubeConfigPath string
+	DockerImage       string
+	KubeConfigPath    string
+	HeartbeatDuration time.Duration
 }
 
 // Execute executes the Worker on EKS
-func (r AWSEKS) Execute(handler MessageHandler) {
-
-	// This inits the handler
-	handler.initialize()
-	// Gets the message
-	handler.receive()
-	fmt.Printf("Message received: %s \n", *(handler.body()))
+func (r AWSEKS) Execute(ctx context.Context, handler source.MessageHandler) {
+	log.Printf("Message received: %s", *(handler.Body()))
+	stopHeartbeat := startHeartbeat(handler, r.HeartbeatDuration)
 
 	var clientset *kubernetes.Clientset
 	if r.KubeConfigPath != "" {
@@ -92,7 +94,7 @@ func (r AWSEKS) Execute(handler MessageHandler) {
 									},
 								},
 								{Name: "SKYAPI_URL", Value: "https://api.skycatch.com/v1/"},
-								{Name: "TASK_PAYLOAD", Value: *(handler.body())},
+								{Name: "TASK_PAYLOAD", Value: *(handler.Body())},
 							},
 							Resources: v1.ResourceRequirements{
 								Limits: v1.ResourceList{
@@ -110,13 +112,27 @@ func (r AWSEKS) Execute(handler MessageHandler) {
 		},
 	}
 
+	for _, pair := range source.TaskEnvironment(handler) {
+		variable := strings.SplitN(pair, "=", 2)
+		job.Spec.Template.Spec.Containers[0].Env = append(job.Spec.Template.Spec.Containers[0].Env, v1.EnvVar{Name: variable[0], Value: variable[1]})
+	}
 	executedJob, err := batchClient.Create(&job)
+	stopHeartbeat()
+	if err == nil && ctx.Err() != nil {
+		// Abandoned or shut down while the Job was created
+		propagation := metav1.DeletePropagationBackground
+		if deleteErr := batchClient.Delete(executedJob.Name, &metav1.DeleteOptions{PropagationPolicy: &propagation}); deleteErr != nil {
+			log.Printf("E: Couldn't delete job %s %s", executedJob.Name, deleteErr.Error())
+		}
+		handler.Failure(result.Result{Error: ctx.Err().Error(), Exit: "SHUTDOWN"})
+		return
+	}
 	if err != nil {
-		handler.failure(result.Result{Error: err.Error(), Exit: fmt.Sprintf("Job %s failed", executedJob.Name)})
+		handler.Failure(result.Result{Error: err.Error(), Exit: fmt.Sprintf("Job %s failed", executedJob.Name)})
 	} else {
 		// TODO David: We need to monitor the job till it finishes. It was launched into the cluster but can be long running
-		spew.Dump(executedJob)
-		handler.success()
+		log.Print(spew.Sdump(executedJob))
+		handler.Success(nil)
 	}
 }
 
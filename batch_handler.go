@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
+)
+
+func init() {
+	source.Register("batch", source.Registration{
+		New: builtin(func(config *Config) source.MessageHandler {
+			return &BatchHandler{
+				batch:     sharedBatch(config.Value("TASK_BATCH_FILE"), config.Value("TASK_BATCH_RESULTS")),
+				idField:   config.Value("TASK_BATCH_ID_FIELD"),
+				bodyField: config.Value("TASK_BATCH_BODY_FIELD"),
+			}
+		}),
+		Settings: []source.Setting{
+			{Name: "TASK_BATCH_FILE", Usage: "JSON Lines file of tasks to run, - reads stdin"},
+			{Name: "TASK_BATCH_RESULTS", Default: "-", Usage: "JSON Lines file the results are appended to, - writes stdout"},
+			{Name: "TASK_BATCH_ID_FIELD", Usage: "Field of each line holding the message ID, the line number when unset"},
+			{Name: "TASK_BATCH_BODY_FIELD", Usage: "Field of each line holding the payload, the whole line when unset"},
+		},
+		Required: []string{"TASK_BATCH_FILE"},
+		Detect: func(config source.Config) bool {
+			return config.Value("TASK_BATCH_FILE") != ""
+		},
+		// Workers stop once the file is read, TASK_CONCURRENCY only sets
+		// how many lines run at once
+		Daemon: true,
+	})
+}
+
+// batchResult is the line written to the results for every task.
+type batchResult struct {
+	ID     string `json:"id"`
+	Line   int    `json:"line"`
+	Status string `json:"status"`
+	*source.TaskResult
+	// Duration is in seconds
+	Duration float64 `json:"duration"`
+	Output   *string `json:"output,omitempty"`
+}
+
+// taskBatch reads the tasks of a JSON Lines file for all workers and writes
+// their results, one line each in the order they finished.
+type taskBatch struct {
+	path        string
+	resultsPath string
+	opening     sync.Once
+	openErr     error
+	mu          sync.Mutex
+	reader      *bufio.Reader
+	results     *json.Encoder
+	line        int
+	eof         bool
+}
+
+var (
+	taskBatchOnce sync.Once
+	taskBatchInst *taskBatch
+)
+
+// sharedBatch creates the batch the first time a worker's handler is built.
+// The files are opened on Initialize.
+func sharedBatch(path string, resultsPath string) *taskBatch {
+	taskBatchOnce.Do(func() {
+		taskBatchInst = &taskBatch{
+			path:        path,
+			resultsPath: resultsPath,
+		}
+	})
+	return taskBatchInst
+}
+
+// open opens the files once, every worker gets the same error.
+func (batch *taskBatch) open() error {
+	batch.opening.Do(func() {
+		input := os.Stdin
+		if batch.path != "-" {
+			file, err := os.Open(batch.path)
+			if err != nil {
+				batch.openErr = err
+				return
+			}
+			input = file
+		}
+		batch.reader = bufio.NewReader(input)
+		output := os.Stdout
+		if batch.resultsPath != "-" {
+			file, err := os.OpenFile(batch.resultsPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				batch.openErr = err
+				return
+			}
+			output = file
+		}
+		batch.results = json.NewEncoder(output)
+	})
+	return batch.openErr
+}
+
+// next returns the next non-blank line and its number, false once the file
+// is read.
+func (batch *taskBatch) next() (string, int, bool) {
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+	for !batch.eof {
+		// ReadString rather than a Scanner, payloads have no size limit
+		text, err := batch.reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Println("E: ", err.Error())
+			}
+			batch.eof = true
+		}
+		if text = strings.TrimSpace(text); text != "" || err == nil {
+			batch.line++
+		}
+		if text != "" {
+			return text, batch.line, true
+		}
+	}
+	return "", 0, false
+}
+
+func (batch *taskBatch) write(record batchResult) {
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+	if err := batch.results.Encode(record); err != nil {
+		log.Printf("E: Couldn't write result of message %s %s", record.ID, err.Error())
+	}
+}
+
+func (batch *taskBatch) done() bool {
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+	return batch.eof
+}
+
+// BatchHandler runs the lines of its worker's shared taskBatch, for
+// backfills and for replaying exported messages. Every line is one task and
+// gets one result, failed tasks are not retried.
+type BatchHandler struct {
+	batch       *taskBatch
+	messageID   string
+	messageBody string
+	line        int
+	started     time.Time
+	idField     string
+	bodyField   string
+}
+
+func (handler *BatchHandler) ID() *string {
+	return &handler.messageID
+}
+
+func (handler *BatchHandler) Body() *string {
+	return &handler.messageBody
+}
+
+// Attributes is nil, a line is only its payload.
+func (handler *BatchHandler) Attributes() map[string]string {
+	return nil
+}
+
+func (handler *BatchHandler) Initialize() error {
+	return handler.batch.open()
+}
+
+func (handler *BatchHandler) Receive() (bool, error) {
+	for {
+		text, line, ok := handler.batch.next()
+		if !ok {
+			log.Println("I: ", "No messages retrieved from batch")
+			return false, nil
+		}
+		handler.line = line
+		handler.messageID = strconv.Itoa(line)
+		handler.messageBody = text
+		handler.started = time.Now()
+		if err := handler.parse(text); err != nil {
+			// Recorded so that every line of the file has a result
+			log.Printf("E: Line %d %s", line, err.Error())
+			r := result.New()
+			r.SetExit("INVALID")
+			handler.Failure(r)
+			continue
+		}
+		return true, nil
+	}
+}
+
+// parse picks the ID and payload out of a line when fields are configured.
+func (handler *BatchHandler) parse(text string) error {
+	if handler.idField == "" && handler.bodyField == "" {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(text), &fields); err != nil {
+		return err
+	}
+	if handler.idField != "" {
+		id, ok := fields[handler.idField]
+		if !ok {
+			return fmt.Errorf("no %s field", handler.idField)
+		}
+		handler.messageID = batchFieldString(id)
+	}
+	if handler.bodyField != "" {
+		body, ok := fields[handler.bodyField]
+		if !ok {
+			return fmt.Errorf("no %s field", handler.bodyField)
+		}
+		handler.messageBody = batchFieldString(body)
+	}
+	return nil
+}
+
+// batchFieldString is the content of a JSON string, other values as JSON.
+func batchFieldString(value json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(value, &text); err == nil {
+		return text
+	}
+	return string(value)
+}
+
+// Exhausted stops the workers once the whole file was read.
+func (handler *BatchHandler) Exhausted() bool {
+	return handler.batch.done()
+}
+
+func (handler *BatchHandler) Success(output *string) {
+	handler.finish(taskSucceeded, output, nil)
+}
+
+// Failure records the failure, including SHUTDOWN. Lines without a
+// succeeded result are the ones to replay again.
+func (handler *BatchHandler) Failure(err result.Result) {
+	handler.finish(taskFailed, nil, source.NewTaskResult(err))
+}
+
+func (handler *BatchHandler) finish(status string, output *string, err *source.TaskResult) {
+	handler.batch.write(batchResult{
+		ID:         handler.messageID,
+		Line:       handler.line,
+		Status:     status,
+		TaskResult: err,
+		Duration:   time.Since(handler.started).Seconds(),
+		Output:     output,
+	})
+}
+
+// Heartbeat does nothing, the file needs no keepalive.
+func (handler *BatchHandler) Heartbeat() {}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Skycatch/tasque-go/result"
+)
+
+// newTestBatch is a taskBatch of its own over content, with its results in
+// the returned file
+func newTestBatch(t *testing.T, content string) (*taskBatch, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tasks.jsonl")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	batch := &taskBatch{path: path, resultsPath: filepath.Join(dir, "results.jsonl")}
+	if err := batch.open(); err != nil {
+		t.Fatal(err)
+	}
+	return batch, batch.resultsPath
+}
+
+func TestTaskBatchNext(t *testing.T) {
+	batch, _ := newTestBatch(t, "{\"a\":1}\n\n   \n{\"b\":2}\r\n{\"c\":3}")
+	for _, want := range []struct {
+		text string
+		line int
+	}{{`{"a":1}`, 1}, {`{"b":2}`, 4}, {`{"c":3}`, 5}} {
+		text, line, ok := batch.next()
+		if !ok || text != want.text || line != want.line {
+			t.Errorf("next() = %q, %d, %t, want %q, %d", text, line, ok, want.text, want.line)
+		}
+	}
+	if text, _, ok := batch.next(); ok || !batch.done() {
+		t.Errorf("next() = %q, %t, done() = %t after the last line", text, ok, batch.done())
+	}
+}
+
+func TestBatchHandlerParse(t *testing.T) {
+	tests := []struct {
+		idField   string
+		bodyField string
+		line      string
+		id        string
+		body      string
+		err       bool
+	}{
+		{"", "", `not json`, "7", `not json`, false},
+		{"id", "", `{"id":"job-1","x":1}`, "job-1", `{"id":"job-1","x":1}`, false},
+		{"id", "", `{"id":42}`, "42", `{"id":42}`, false},
+		{"", "payload", `{"payload":{"hello":"world"}}`, "7", `{"hello":"world"}`, false},
+		// String payloads are passed unquoted
+		{"id", "payload", `{"id":"job-1","payload":"{\"hello\":\"world\"}"}`, "job-1", `{"hello":"world"}`, false},
+		{"id", "", `{"name":"job-1"}`, "", "", true},
+		{"", "payload", `{"body":{}}`, "", "", true},
+		{"id", "payload", `not json`, "", "", true},
+	}
+	for _, test := range tests {
+		handler := &BatchHandler{idField: test.idField, bodyField: test.bodyField, messageID: "7", messageBody: test.line}
+		err := handler.parse(test.line)
+		if (err != nil) != test.err {
+			t.Errorf("parse(%s) with %q, %q = %v, want error %t", test.line, test.idField, test.bodyField, err, test.err)
+			continue
+		}
+		if err == nil && (handler.messageID != test.id || handler.messageBody != test.body) {
+			t.Errorf("parse(%s) with %q, %q = %s, %s, want %s, %s", test.line, test.idField, test.bodyField, handler.messageID, handler.messageBody, test.id, test.body)
+		}
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	batch, resultsPath := newTestBatch(t, strings.Join([]string{
+		`{"id":"first","payload":{"n":1}}`,
+		`{"payload":{"n":2}}`,
+		`{"id":"third","payload":{"n":3}}`,
+	}, "\n")+"\n")
+	// Two workers share the batch
+	first := &BatchHandler{batch: batch, idField: "id", bodyField: "payload"}
+	second := &BatchHandler{batch: batch, idField: "id", bodyField: "payload"}
+
+	if received, err := first.Receive(); !received || err != nil || *first.ID() != "first" || *first.Body() != `{"n":1}` {
+		t.Fatalf("Receive() = %t, %v with %s %s, want the first line", received, err, *first.ID(), *first.Body())
+	}
+	// The line without an id is recorded as INVALID and skipped
+	if received, err := second.Receive(); !received || err != nil || *second.ID() != "third" {
+		t.Fatalf("Receive() = %t, %v with %s, want the third line", received, err, *second.ID())
+	}
+	output := `{"done":true}`
+	first.Success(&output)
+	failure := result.New()
+	failure.SetExit("1")
+	second.Failure(failure)
+	if received, err := first.Receive(); received || err != nil || !first.Exhausted() || !second.Exhausted() {
+		t.Fatalf("Receive() = %t, %v, Exhausted() = %t, %t, want both exhausted", received, err, first.Exhausted(), second.Exhausted())
+	}
+
+	file, err := os.Open(resultsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var results []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("result %s: %v", scanner.Text(), err)
+		}
+		results = append(results, record)
+	}
+	if len(results) != 3 {
+		t.Fatalf("%d results, want one per line", len(results))
+	}
+	// In the order the tasks finished
+	for i, want := range []struct {
+		id     string
+		line   float64
+		status string
+		exit   string
+		keys   string
+	}{
+		{"2", 2, "failed", "INVALID", "duration error exit id line message status"},
+		{"first", 1, "succeeded", "", "duration id line output status"},
+		{"third", 3, "failed", "1", "duration error exit id line message status"},
+	} {
+		record := results[i]
+		var keys []string
+		for key := range record {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, " ") != want.keys {
+			t.Errorf("result %d has %v, want %s", i, keys, want.keys)
+		}
+		if record["id"] != want.id || record["line"] != want.line || record["status"] != want.status {
+			t.Errorf("result %d = %v, want %s line %v %s", i, record, want.id, want.line, want.status)
+		}
+		if exit, _ := record["exit"].(string); exit != want.exit {
+			t.Errorf("result %d exit = %q, want %q", i, exit, want.exit)
+		}
+	}
+	if results[1]["output"] != output {
+		t.Errorf("output = %v, want %s", results[1]["output"], output)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// Build metadata, injected with -ldflags by the Makefile
+var (
+	Version    = "dev"
+	GitCommit  = "unknown"
+	GitBranch  = "unknown"
+	GitSummary = "unknown"
+	BuildDate  = "unknown"
+)
+
+var commands = []string{"run", "worker", "validate", "config", "version"}
+
+// splitCommand separates the subcommand from its arguments. Without a known
+// subcommand all arguments are returned, so `tasque npm start` keeps working.
+func splitCommand(args []string) (string, []string) {
+	if len(args) > 0 {
+		for _, command := range commands {
+			if args[0] == command {
+				return command, args[1:]
+			}
+		}
+	}
+	return "", args
+}
+
+func usage(w io.Writer) {
+	fmt.Fprint(w, `Usage:
+  tasque run [flags] -- command [args]   Run command as a child process for every message
+  tasque worker --deploy=ecs|docker|eks  Run every message as a sibling container
+  tasque validate [flags]                Check the configuration and task definition
+  tasque config print [flags]            Show the effective configuration, secrets redacted
+  tasque version                         Show build information
+
+Without a subcommand tasque runs as a worker when DOCKER is set and runs its
+arguments as a command otherwise.
+
+Flags:
+`)
+}
+
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "tasque %s (%s)\n", Version, GitSummary)
+	fmt.Fprintf(w, "commit:  %s\n", GitCommit)
+	fmt.Fprintf(w, "branch:  %s\n", GitBranch)
+	fmt.Fprintf(w, "built:   %s\n", BuildDate)
+	fmt.Fprintf(w, "go:      %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func configCommand(config *Config, arguments []string) {
+	if len(arguments) != 1 || arguments[0] != "print" {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	if err := config.print(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// validateCommand checks the configuration and, for worker mode, that the
+// task definition can actually be run.
+func validateCommand(config *Config) {
+	if err := config.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if config.Docker {
+		if err := validateTaskDefinition(config); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Println("Configuration is valid")
+}
+
+func validateTaskDefinition(config *Config) error {
+	switch config.DeployMethod {
+	case "DOCKER":
+		var errors []string
+		if config.DockerTaskDefinition.ImageName == "" {
+			errors = append(errors, "DOCKER_TASK_DEFINITION: ImageName is required")
+		}
+		if _, err := fetchAuthConfiguration(config.DockerAuthData); err != nil {
+			errors = append(errors, fmt.Sprintf("DOCKER_AUTH_DATA: %s", err.Error()))
+		}
+		if len(errors) > 0 {
+			return ConfigError(errors)
+		}
+	case "ECS":
+		return validateECSTaskDefinition(config)
+	}
+	return nil
+}
+
+// validateECSTaskDefinition checks that ECS_TASK_DEFINITION exists and has
+// the container the payload is sent to.
+func validateECSTaskDefinition(config *Config) error {
+	region := config.AWSRegion
+	if region == "" {
+		// Tasks are started in us-west-2, see startECSContainer
+		region = "us-west-2"
+	}
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return err
+	}
+	resp, err := ecs.New(sess).DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(config.ECSTaskDefinition),
+	})
+	if err != nil {
+		return ConfigError{fmt.Sprintf("ECS_TASK_DEFINITION: %s", err.Error())}
+	}
+	for _, container := range resp.TaskDefinition.ContainerDefinitions {
+		if aws.StringValue(container.Name) == config.ECSContainerName {
+			return nil
+		}
+	}
+	return ConfigError{fmt.Sprintf("ECS_CONTAINER_NAME: no container %s in %s", config.ECSContainerName, config.ECSTaskDefinition)}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		command   string
+		arguments []string
+	}{
+		{"no arguments", nil, "", nil},
+		{"run", []string{"run", "--", "node", "worker.js"}, "run", []string{"--", "node", "worker.js"}},
+		{"worker", []string{"worker", "--deploy=ecs"}, "worker", []string{"--deploy=ecs"}},
+		{"validate", []string{"validate"}, "validate", []string{}},
+		{"config print", []string{"config", "print"}, "config", []string{"print"}},
+		{"version", []string{"version"}, "version", []string{}},
+		{"legacy command", []string{"node", "worker.js"}, "", []string{"node", "worker.js"}},
+		{"legacy flags", []string{"--task-heartbeat=10s", "node", "worker.js"}, "", []string{"--task-heartbeat=10s", "node", "worker.js"}},
+		// Only the first argument can be a subcommand
+		{"subcommand as argument", []string{"node", "run"}, "", []string{"node", "run"}},
+		{"subcommand after --", []string{"--", "run"}, "", []string{"--", "run"}},
+	}
+	for _, test := range tests {
+		command, arguments := splitCommand(test.args)
+		if command != test.command || !reflect.DeepEqual(arguments, test.arguments) {
+			t.Errorf("%s: splitCommand(%q) = %q, %q, want %q, %q", test.name, test.args, command, arguments, test.command, test.arguments)
+		}
+	}
+}
+
+// TestSplitCommandArguments follows the arguments through loadConfig, which
+// takes the flags off and leaves the command to run.
+func TestSplitCommandArguments(t *testing.T) {
+	t.Setenv("TASQUE_CONFIG", "")
+	t.Setenv("TASK_HEARTBEAT", "")
+	tests := []struct {
+		name      string
+		args      []string
+		command   string
+		arguments []string
+		heartbeat string
+	}{
+		{"legacy command", []string{"node", "worker.js"}, "", []string{"node", "worker.js"}, "30s"},
+		{"legacy flags", []string{"--task-heartbeat=10s", "node", "worker.js", "--verbose"}, "", []string{"node", "worker.js", "--verbose"}, "10s"},
+		{"legacy --", []string{"--task-heartbeat=10s", "--", "node", "--verbose"}, "", []string{"node", "--verbose"}, "10s"},
+		{"run", []string{"run", "--task-heartbeat=10s", "--", "node", "worker.js"}, "run", []string{"node", "worker.js"}, "10s"},
+		// Flags after -- belong to the command
+		{"run flags after --", []string{"run", "--", "--task-heartbeat=10s"}, "run", []string{"--task-heartbeat=10s"}, "30s"},
+		{"subcommand after --", []string{"--", "run", "worker.js"}, "", []string{"run", "worker.js"}, "30s"},
+	}
+	for _, test := range tests {
+		command, args := splitCommand(test.args)
+		config, arguments, err := loadConfig(args)
+		if err != nil {
+			t.Errorf("%s: loadConfig(%q) = %v", test.name, args, err)
+			continue
+		}
+		if command != test.command || !reflect.DeepEqual(arguments, test.arguments) {
+			t.Errorf("%s: %q runs %q with %q, want %q with %q", test.name, test.args, command, arguments, test.command, test.arguments)
+		}
+		if config.Heartbeat.String() != test.heartbeat {
+			t.Errorf("%s: TASK_HEARTBEAT = %s, want %s", test.name, config.Heartbeat, test.heartbeat)
+		}
+	}
+}
+
+func TestPrintVersion(t *testing.T) {
+	defer func(version, commit, branch, summary, date string) {
+		Version, GitCommit, GitBranch, GitSummary, BuildDate = version, commit, branch, summary, date
+	}(Version, GitCommit, GitBranch, GitSummary, BuildDate)
+	Version, GitCommit, GitBranch, GitSummary, BuildDate = "1.2.0", "abc123", "master", "v1.2.0-3-gabc123", "2020-01-02"
+
+	var out bytes.Buffer
+	printVersion(&out)
+	want := []string{
+		"tasque 1.2.0 (v1.2.0-3-gabc123)",
+		"commit:  abc123",
+		"branch:  master",
+		"built:   2020-01-02",
+		"go:      " + runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); !reflect.DeepEqual(lines, want) {
+		t.Errorf("printVersion() = %q, want %q", lines, want)
+	}
+}
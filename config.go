@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skycatch/tasque-go/source"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is every setting tasque reads. Settings are named after their
+// environment variable and can also come from a YAML/JSON config file or a
+// command line flag, see loadConfig.
+type Config struct {
+	Docker       bool
+	DeployMethod string
+
+	DockerContainerName  string
+	DockerTaskDefinition DockerTaskDefinition
+	DockerEndpoint       string
+	DockerAuthData       string
+	ECSTaskDefinition    string
+	ECSContainerName     string
+	KubeConfigPath       string
+	EKSDockerImage       string
+
+	TaskSource      string
+	TaskPayload     string
+	TaskQueueURL    string
+	TaskActivityARN string
+	AWSRegion       string
+
+	Timeout           time.Duration
+	Heartbeat         time.Duration
+	ShutdownGrace     time.Duration
+	VisibilityTimeout time.Duration
+	Concurrency       int
+	MaxMessages       int
+
+	RetryBackoff       time.Duration
+	RetryBackoffMax    time.Duration
+	MaxAttempts        int
+	DeadLetterQueueURL string
+	ReplyQueueURL      string
+
+	OutputCapture string
+	OutputPath    string
+
+	ErrorMessageTemplate string
+	ExitTranslations     map[string]string
+
+	// values are the effective raw settings, errors the problems found
+	// while parsing them
+	values map[string]string
+	errors []string
+}
+
+// builtin adapts the constructor of a source built into tasque, which reads
+// the shared settings already parsed into Config, to a source.Factory.
+func builtin(build func(config *Config) source.MessageHandler) source.Factory {
+	return func(config source.Config) source.MessageHandler {
+		return build(config.(*Config))
+	}
+}
+
+// exitPrefix marks the error translation settings, see result.SetExit
+const exitPrefix = "EXIT_"
+
+var settings = []source.Setting{
+	{Name: "DOCKER", Usage: "Run tasks as sibling containers, see DEPLOY_METHOD"},
+	{Name: "DEPLOY_METHOD", Default: "ECS", Usage: "ECS, DOCKER or EKS"},
+	{Name: "DOCKER_CONTAINER_NAME", Usage: "Container name for the DOCKER deploy method"},
+	{Name: "DOCKER_TASK_DEFINITION", Usage: "JSON container definition for the DOCKER deploy method"},
+	{Name: "DOCKER_ENDPOINT", Default: "unix:///var/run/docker.sock", Usage: "Docker API endpoint"},
+	{Name: "DOCKER_AUTH_DATA", Usage: "JSON registry credentials for the DOCKER deploy method", Secret: true},
+	{Name: "ECS_TASK_DEFINITION", Usage: "Task definition for the ECS deploy method"},
+	{Name: "ECS_CONTAINER_NAME", Usage: "Container in ECS_TASK_DEFINITION that receives the payload"},
+	{Name: "KUBE_CONFIG_PATH", Usage: "kubeconfig for the EKS deploy method, in-cluster config when unset"},
+	{Name: "VW_DOCKER_IMAGE", Usage: "Image for the EKS deploy method"},
+	{Name: "TASK_SOURCE", Usage: "Message source, detected from the other settings when unset"},
+	{Name: "TASK_PAYLOAD", Usage: "Run this single payload"},
+	{Name: "TASK_QUEUE_URL", Usage: "SQS queue to receive from"},
+	{Name: "TASK_ACTIVITY_ARN", Usage: "Step Functions activity to receive from"},
+	{Name: "AWS_REGION", Usage: "AWS region of the SQS queue or Step Functions activity"},
+	{Name: "TASK_TIMEOUT", Default: "30s", Usage: "Longest a task may run"},
+	{Name: "TASK_HEARTBEAT", Default: "30s", Usage: "Heartbeat interval while a task runs"},
+	{Name: "TASK_SHUTDOWN_GRACE", Default: "25s", Usage: "Time running tasks get to exit after SIGTERM"},
+	{Name: "TASK_VISIBILITY_TIMEOUT", Usage: "SQS visibility each heartbeat extends to, twice TASK_HEARTBEAT when unset"},
+	{Name: "TASK_CONCURRENCY", Usage: "Run as a daemon with this many workers"},
+	{Name: "TASK_MAX_MESSAGES", Default: "0", Usage: "Messages a daemon handles before exiting, 0 is unlimited"},
+	{Name: "TASK_RETRY_BACKOFF", Default: "30s", Usage: "SQS visibility after the first failure, doubled per receive"},
+	{Name: "TASK_RETRY_BACKOFF_MAX", Default: "15m", Usage: "Upper bound for TASK_RETRY_BACKOFF"},
+	{Name: "TASK_MAX_ATTEMPTS", Default: "0", Usage: "Receives before a failed SQS message is dead lettered, 0 retries forever"},
+	{Name: "TASK_DEAD_LETTER_QUEUE_URL", Usage: "SQS queue for messages that failed TASK_MAX_ATTEMPTS times"},
+	{Name: "TASK_REPLY_QUEUE_URL", Usage: "SQS queue task output is published to"},
+	{Name: "TASK_OUTPUT_CAPTURE", Default: outputFile, Usage: "file, stdout or none"},
+	{Name: "TASK_OUTPUT_PATH", Usage: "Fixed path tasks write their output to"},
+	{Name: "ERROR_MESSAGE_TEMPLATE", Usage: "Go template for failure messages"},
+}
+
+// allSettings are tasque's own settings followed by those of every
+// registered source.
+func allSettings() []source.Setting {
+	return append(append([]source.Setting{}, settings...), source.Settings()...)
+}
+
+// deployRequirements are the settings each DEPLOY_METHOD can't run without.
+var deployRequirements = map[string][]string{
+	"DOCKER": {"DOCKER_CONTAINER_NAME", "DOCKER_TASK_DEFINITION", "DOCKER_AUTH_DATA"},
+	"ECS":    {"ECS_TASK_DEFINITION", "ECS_CONTAINER_NAME"},
+	"EKS":    {"VW_DOCKER_IMAGE"},
+}
+
+// ConfigError lists every missing or invalid setting at once.
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(e, "\n  "))
+}
+
+// flagName turns TASK_QUEUE_URL into task-queue-url.
+func flagName(name string) string {
+	return strings.Replace(strings.ToLower(name), "_", "-", -1)
+}
+
+// loadConfig reads settings from, in increasing order of precedence, the
+// file given by --config or TASQUE_CONFIG, the environment and the command
+// line flags. It returns the arguments left after the flags.
+func loadConfig(args []string) (*Config, []string, error) {
+	flags := flag.NewFlagSet("tasque", flag.ContinueOnError)
+	flags.Usage = func() {
+		usage(flags.Output())
+		flags.PrintDefaults()
+	}
+	configPath := flags.String("config", os.Getenv("TASQUE_CONFIG"), "YAML or JSON config file")
+	deploy := flags.String("deploy", "", "Run tasks as sibling containers with this deploy method, same as --docker=true --deploy-method=...")
+	for _, s := range allSettings() {
+		flags.String(flagName(s.Name), "", s.Usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	values := map[string]string{}
+	if *configPath != "" {
+		if err := readConfigFile(*configPath, values); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, s := range allSettings() {
+		if value := os.Getenv(s.Name); value != "" {
+			values[s.Name] = value
+		}
+	}
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, exitPrefix) {
+			pair := strings.SplitN(env, "=", 2)
+			values[pair[0]] = pair[1]
+		}
+	}
+	for _, s := range allSettings() {
+		if f := flags.Lookup(flagName(s.Name)); f.Value.String() != "" {
+			values[s.Name] = f.Value.String()
+		}
+	}
+	if *deploy != "" {
+		values["DOCKER"] = "true"
+		values["DEPLOY_METHOD"] = *deploy
+	}
+	return parseConfig(values), flags.Args(), nil
+}
+
+func readConfigFile(path string, values map[string]string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// YAML is a superset of JSON, this reads both
+	file := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	var errors []string
+	for name, value := range file {
+		if lookupSetting(name) == nil && !strings.HasPrefix(name, exitPrefix) {
+			errors = append(errors, fmt.Sprintf("%s: unknown setting %s", path, name))
+			continue
+		}
+		values[name], err = configValue(value)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %s: %s", path, name, err.Error()))
+		}
+	}
+	if len(errors) > 0 {
+		sort.Strings(errors)
+		return ConfigError(errors)
+	}
+	return nil
+}
+
+// configValue turns a config file value into a setting. Nested values like
+// DOCKER_TASK_DEFINITION are kept as the JSON they are given as in the
+// environment.
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case map[string]interface{}, []interface{}:
+		encoded, err := json.Marshal(v)
+		return string(encoded), err
+	case float64:
+		// JSON numbers, written out without an exponent
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case nil:
+		return "", nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+func lookupSetting(name string) *source.Setting {
+	all := allSettings()
+	for i := range all {
+		if all[i].Name == name {
+			return &all[i]
+		}
+	}
+	return nil
+}
+
+// parseConfig converts the raw values, recording every problem instead of
+// stopping at the first one.
+func parseConfig(values map[string]string) *Config {
+	c := &Config{values: values, ExitTranslations: map[string]string{}}
+
+	c.Docker = c.Bool("DOCKER")
+	c.DeployMethod = strings.ToUpper(c.Value("DEPLOY_METHOD"))
+	c.DockerContainerName = c.Value("DOCKER_CONTAINER_NAME")
+	if definition := c.Value("DOCKER_TASK_DEFINITION"); definition != "" {
+		if err := json.Unmarshal([]byte(definition), &c.DockerTaskDefinition); err != nil {
+			c.Invalid("DOCKER_TASK_DEFINITION", err.Error())
+		}
+	}
+	c.DockerEndpoint = c.Value("DOCKER_ENDPOINT")
+	c.DockerAuthData = c.Value("DOCKER_AUTH_DATA")
+	c.ECSTaskDefinition = c.Value("ECS_TASK_DEFINITION")
+	c.ECSContainerName = c.Value("ECS_CONTAINER_NAME")
+	c.KubeConfigPath = c.Value("KUBE_CONFIG_PATH")
+	c.EKSDockerImage = c.Value("VW_DOCKER_IMAGE")
+
+	c.TaskSource = strings.ToLower(c.Value("TASK_SOURCE"))
+	c.TaskPayload = c.Value("TASK_PAYLOAD")
+	c.TaskQueueURL = c.Value("TASK_QUEUE_URL")
+	c.TaskActivityARN = c.Value("TASK_ACTIVITY_ARN")
+	c.AWSRegion = c.Value("AWS_REGION")
+
+	c.Timeout = c.positiveDuration("TASK_TIMEOUT")
+	c.Heartbeat = c.positiveDuration("TASK_HEARTBEAT")
+	c.ShutdownGrace = c.Duration("TASK_SHUTDOWN_GRACE")
+	c.VisibilityTimeout = c.Duration("TASK_VISIBILITY_TIMEOUT")
+	if c.VisibilityTimeout == 0 {
+		// Survive one missed heartbeat
+		c.VisibilityTimeout = 2 * c.Heartbeat
+	}
+	c.Concurrency = c.Int("TASK_CONCURRENCY")
+	c.MaxMessages = c.Int("TASK_MAX_MESSAGES")
+
+	c.RetryBackoff = c.Duration("TASK_RETRY_BACKOFF")
+	c.RetryBackoffMax = c.Duration("TASK_RETRY_BACKOFF_MAX")
+	c.MaxAttempts = c.Int("TASK_MAX_ATTEMPTS")
+	c.DeadLetterQueueURL = c.Value("TASK_DEAD_LETTER_QUEUE_URL")
+	c.ReplyQueueURL = c.Value("TASK_REPLY_QUEUE_URL")
+
+	c.OutputCapture = strings.ToLower(c.Value("TASK_OUTPUT_CAPTURE"))
+	switch c.OutputCapture {
+	case outputFile, outputStdout, outputNone:
+	default:
+		c.Invalid("TASK_OUTPUT_CAPTURE", "must be file, stdout or none")
+	}
+	c.OutputPath = c.Value("TASK_OUTPUT_PATH")
+
+	c.ErrorMessageTemplate = c.Value("ERROR_MESSAGE_TEMPLATE")
+	for name, value := range values {
+		if strings.HasPrefix(name, exitPrefix) {
+			c.ExitTranslations[strings.TrimPrefix(name, exitPrefix)] = value
+		}
+	}
+	return c
+}
+
+// Value returns a setting or its default. Config is the source.Config
+// message sources read their own settings through, problems are reported by
+// validate.
+func (c *Config) Value(name string) string {
+	if value, ok := c.values[name]; ok {
+		return value
+	}
+	if s := lookupSetting(name); s != nil {
+		return s.Default
+	}
+	return ""
+}
+
+// Invalid records a problem with a setting for validate to report.
+func (c *Config) Invalid(name string, reason string) {
+	c.errors = append(c.errors, fmt.Sprintf("%s: %s", name, reason))
+}
+
+func (c *Config) Duration(name string) time.Duration {
+	value := c.Value(name)
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		c.Invalid(name, err.Error())
+	}
+	return d
+}
+
+// positiveDuration is a Duration that must be above zero, like an interval
+// a ticker is started with.
+func (c *Config) positiveDuration(name string) time.Duration {
+	value := c.Value(name)
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		c.Invalid(name, err.Error())
+	} else if d <= 0 {
+		c.Invalid(name, fmt.Sprintf("%q must be positive", value))
+	}
+	return d
+}
+
+func (c *Config) Bool(name string) bool {
+	value := c.Value(name)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		c.Invalid(name, fmt.Sprintf("%q is not true or false", value))
+	}
+	return b
+}
+
+func (c *Config) Int(name string) int {
+	value := c.Value(name)
+	if value == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		c.Invalid(name, fmt.Sprintf("%q is not a non-negative integer", value))
+	}
+	return i
+}
+
+// validate reports the parse errors together with the settings the chosen
+// message handler and deploy method are missing.
+func (c *Config) validate() error {
+	var errors []string
+	if name, registration, err := source.Select(c); err != nil {
+		errors = append(errors, err.Error())
+	} else {
+		for _, required := range registration.Required {
+			if c.Value(required) == "" {
+				errors = append(errors, fmt.Sprintf("%s: required by TASK_SOURCE %s", required, name))
+			}
+		}
+		// Handlers parse their own settings when they are built
+		registration.New(c)
+	}
+	errors = append(append([]string{}, c.errors...), errors...)
+	if c.Docker {
+		required, ok := deployRequirements[c.DeployMethod]
+		if !ok {
+			errors = append(errors, fmt.Sprintf("DEPLOY_METHOD: unknown deploy method %q", c.DeployMethod))
+		}
+		for _, name := range required {
+			if c.Value(name) == "" {
+				errors = append(errors, fmt.Sprintf("%s: required by DEPLOY_METHOD %s", name, c.DeployMethod))
+			}
+		}
+	}
+	if len(errors) > 0 {
+		return ConfigError(errors)
+	}
+	return nil
+}
+
+// print writes the effective settings as YAML, which can be read back with
+// --config. Secrets are redacted.
+func (c *Config) print(w io.Writer) error {
+	effective := map[string]string{}
+	for _, s := range allSettings() {
+		value := c.Value(s.Name)
+		if value == "" {
+			continue
+		}
+		if s.Secret {
+			value = "REDACTED"
+		}
+		effective[s.Name] = value
+	}
+	for name, value := range c.values {
+		if strings.HasPrefix(name, exitPrefix) {
+			effective[name] = value
+		}
+	}
+	out, err := yaml.Marshal(effective)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigDefaults(t *testing.T) {
+	c := parseConfig(map[string]string{})
+	if len(c.errors) > 0 {
+		t.Fatalf("errors = %v, want none", c.errors)
+	}
+	if c.Docker {
+		t.Error("Docker = true without DOCKER")
+	}
+	if c.Heartbeat != 30*time.Second || c.VisibilityTimeout != time.Minute {
+		t.Errorf("Heartbeat, VisibilityTimeout = %s, %s, want 30s, 1m", c.Heartbeat, c.VisibilityTimeout)
+	}
+	if c.Timeout != 30*time.Second || c.ShutdownGrace != 25*time.Second {
+		t.Errorf("Timeout, ShutdownGrace = %s, %s, want 30s, 25s", c.Timeout, c.ShutdownGrace)
+	}
+}
+
+func TestParseConfigDocker(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    bool
+		invalid bool
+	}{
+		{"true", true, false},
+		{"1", true, false},
+		{"false", false, false},
+		{"0", false, false},
+		{"yes", false, true},
+	}
+	for _, test := range tests {
+		c := parseConfig(map[string]string{"DOCKER": test.value})
+		if c.Docker != test.want {
+			t.Errorf("DOCKER=%s: Docker = %t, want %t", test.value, c.Docker, test.want)
+		}
+		if invalid := len(c.errors) > 0; invalid != test.invalid {
+			t.Errorf("DOCKER=%s: errors = %v", test.value, c.errors)
+		}
+	}
+}
+
+func TestParseConfigRejectsHeartbeat(t *testing.T) {
+	for _, value := range []string{"0s", "-1s", "soon"} {
+		c := parseConfig(map[string]string{"TASK_HEARTBEAT": value})
+		if len(c.errors) != 1 || !strings.HasPrefix(c.errors[0], "TASK_HEARTBEAT: ") {
+			t.Errorf("TASK_HEARTBEAT=%s: errors = %v, want one TASK_HEARTBEAT error", value, c.errors)
+		}
+	}
+}
+
+func TestParseConfigVisibilityTimeout(t *testing.T) {
+	c := parseConfig(map[string]string{"TASK_HEARTBEAT": "10s"})
+	if c.VisibilityTimeout != 20*time.Second {
+		t.Errorf("VisibilityTimeout = %s, want twice TASK_HEARTBEAT", c.VisibilityTimeout)
+	}
+	c = parseConfig(map[string]string{"TASK_HEARTBEAT": "10s", "TASK_VISIBILITY_TIMEOUT": "5m"})
+	if c.VisibilityTimeout != 5*time.Minute {
+		t.Errorf("VisibilityTimeout = %s, want 5m", c.VisibilityTimeout)
+	}
+}
+
+func TestParseConfigExitTranslations(t *testing.T) {
+	c := parseConfig(map[string]string{"EXIT_TIMEOUT": "TaskTimedOut", "EXIT_1": "Failed"})
+	if c.ExitTranslations["TIMEOUT"] != "TaskTimedOut" || c.ExitTranslations["1"] != "Failed" {
+		t.Errorf("ExitTranslations = %v", c.ExitTranslations)
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasque.yaml")
+	content := `
+DOCKER: true
+DEPLOY_METHOD: docker
+TASK_CONCURRENCY: 1000000
+TASK_HEARTBEAT: 10s
+DOCKER_TASK_DEFINITION:
+  ImageName: example/task:latest
+  Env:
+    - MODE=batch
+EXIT_TIMEOUT: TaskTimedOut
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	if err := readConfigFile(path, values); err != nil {
+		t.Fatal(err)
+	}
+	c := parseConfig(values)
+	if len(c.errors) > 0 {
+		t.Fatalf("errors = %v, want none", c.errors)
+	}
+	if !c.Docker || c.DeployMethod != "DOCKER" || c.Concurrency != 1000000 || c.Heartbeat != 10*time.Second {
+		t.Errorf("Docker, DeployMethod, Concurrency, Heartbeat = %t, %s, %d, %s", c.Docker, c.DeployMethod, c.Concurrency, c.Heartbeat)
+	}
+	definition := c.DockerTaskDefinition
+	if definition.ImageName != "example/task:latest" || len(definition.Env) != 1 || definition.Env[0] != "MODE=batch" {
+		t.Errorf("DockerTaskDefinition = %+v", definition)
+	}
+	if c.ExitTranslations["TIMEOUT"] != "TaskTimedOut" {
+		t.Errorf("ExitTranslations = %v", c.ExitTranslations)
+	}
+}
+
+func TestReadConfigFileRejectsUnknownSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasque.json")
+	if err := ioutil.WriteFile(path, []byte(`{"TASK_QUEUE": "jobs", "TASK_TIMEOUT": "1m"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := readConfigFile(path, map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "unknown setting TASK_QUEUE") {
+		t.Errorf("readConfigFile() = %v, want unknown setting TASK_QUEUE", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+		want   []string
+	}{
+		{
+			name:   "payload",
+			values: map[string]string{"TASK_PAYLOAD": "{}"},
+		},
+		{
+			name:   "no source",
+			values: map[string]string{},
+			want:   []string{"TASK_SOURCE: no message source configured"},
+		},
+		{
+			name:   "unknown source",
+			values: map[string]string{"TASK_SOURCE": "carrier-pigeon"},
+			want:   []string{`TASK_SOURCE: unknown source "carrier-pigeon"`},
+		},
+		{
+			name:   "missing source setting",
+			values: map[string]string{"TASK_SOURCE": "sqs"},
+			want:   []string{"TASK_QUEUE_URL: required by TASK_SOURCE sqs"},
+		},
+		{
+			name: "every problem at once",
+			values: map[string]string{
+				"TASK_PAYLOAD":   "{}",
+				"TASK_TIMEOUT":   "forever",
+				"DOCKER":         "true",
+				"DEPLOY_METHOD":  "ecs",
+				"TASK_HEARTBEAT": "0s",
+			},
+			want: []string{
+				"TASK_TIMEOUT: ",
+				`TASK_HEARTBEAT: "0s" must be positive`,
+				"ECS_TASK_DEFINITION: required by DEPLOY_METHOD ECS",
+				"ECS_CONTAINER_NAME: required by DEPLOY_METHOD ECS",
+			},
+		},
+		{
+			name:   "zero timeout",
+			values: map[string]string{"TASK_PAYLOAD": "{}", "TASK_TIMEOUT": "0"},
+			want:   []string{`TASK_TIMEOUT: "0" must be positive`},
+		},
+		{
+			name:   "negative timeout",
+			values: map[string]string{"TASK_PAYLOAD": "{}", "TASK_TIMEOUT": "-5m"},
+			want:   []string{`TASK_TIMEOUT: "-5m" must be positive`},
+		},
+		{
+			name:   "postgres poll interval",
+			values: map[string]string{"TASK_POSTGRES_URL": "postgres://localhost/tasque", "TASK_POSTGRES_POLL_INTERVAL": "0s"},
+			want:   []string{`TASK_POSTGRES_POLL_INTERVAL: "0s" must be positive`},
+		},
+		{
+			name:   "spool poll interval",
+			values: map[string]string{"TASK_SPOOL_DIR": "spool", "TASK_SPOOL_POLL_INTERVAL": "-1s"},
+			want:   []string{`TASK_SPOOL_POLL_INTERVAL: "-1s" must be positive`},
+		},
+		{
+			name:   "unknown deploy method",
+			values: map[string]string{"TASK_PAYLOAD": "{}", "DOCKER": "true", "DEPLOY_METHOD": "lambda"},
+			want:   []string{`DEPLOY_METHOD: unknown deploy method "LAMBDA"`},
+		},
+	}
+	for _, test := range tests {
+		err := parseConfig(test.values).validate()
+		if len(test.want) == 0 {
+			if err != nil {
+				t.Errorf("%s: validate() = %v, want nil", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: validate() = nil, want %v", test.name, test.want)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: validate() = %v, want it to contain %q", test.name, err, want)
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -11,7 +12,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/blaines/tasque-go/result"
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
 	"github.com/fsouza/go-dockerclient"
 )
 
@@ -34,16 +36,21 @@ type AWSDOCKER struct {
 	containerName        string
 	taskArn              string
 	timeout              time.Duration
+	grace                time.Duration
+	heartbeat            time.Duration
 	dockerClient         *docker.Client
 	eventsCh             chan *docker.APIEvents
 	containerArgs        string
 	dockerTaskDefinition DockerTaskDefinition
 	result               result.Result
 	authData             string
+	captureMode          string
+	outputPath           string
+	output               *string
 }
 
-func (dockerobj AWSDOCKER) Execute(handler MessageHandler) {
-	dockerobj.execute(handler)
+func (dockerobj AWSDOCKER) Execute(ctx context.Context, handler source.MessageHandler) {
+	dockerobj.execute(ctx, handler)
 }
 
 func (executable *AWSDOCKER) Result() result.Result {
@@ -52,8 +59,12 @@ func (executable *AWSDOCKER) Result() result.Result {
 
 func (dockerobj *AWSDOCKER) createDockerContainer(messageBody *string, args []string, env []string, attachStdout bool) (string, error) {
 	var taskPayloadEnv []string
-	fmt.Println(dockerobj.dockerTaskDefinition.Env)
+	log.Println(dockerobj.dockerTaskDefinition.Env)
 	taskPayloadEnv = append(taskPayloadEnv, fmt.Sprintf("TASK_PAYLOAD=%s", *messageBody))
+	if dockerobj.captureMode != outputNone {
+		taskPayloadEnv = append(taskPayloadEnv, fmt.Sprintf("TASK_OUTPUT_PATH=%s", dockerobj.containerOutputPath()))
+	}
+	taskPayloadEnv = append(taskPayloadEnv, env...)
 	taskPayloadEnv = append(taskPayloadEnv, dockerobj.dockerTaskDefinition.Env...)
 
 	dockerConfig := docker.Config{
@@ -118,6 +129,9 @@ func fetchAuthConfiguration(authDataStr string) (docker.AuthConfiguration, error
 		return docker.AuthConfiguration{}, err
 	}
 	parts := strings.SplitN(string(decodedToken), ":", 2)
+	if len(parts) != 2 {
+		return docker.AuthConfiguration{}, fmt.Errorf("auth is not a base64 encoded username:password")
+	}
 	return docker.AuthConfiguration{
 		Username:      parts[0],
 		Password:      parts[1],
@@ -276,7 +290,7 @@ func (dockerobj *AWSDOCKER) Start(messageBody *string, args []string, env []stri
 					return
 				}
 
-				log.Printf(line)
+				log.Print(line)
 			}
 		}()
 	}
@@ -315,40 +329,43 @@ func (dockerobj *AWSDOCKER) Destroy(id string, force bool, noprune bool) error {
 	return err
 }
 
-func (dockerobj AWSDOCKER) execute(handler MessageHandler) {
-	handler.initialize()
-	if handler.receive() {
-		dockerobj.dockerobjTimeoutHelper(handler)
-	}
+func (dockerobj AWSDOCKER) execute(ctx context.Context, handler source.MessageHandler) {
+	dockerobj.dockerobjTimeoutHelper(ctx, handler)
 }
 
-func (dockerobj *AWSDOCKER) dockerobjTimeoutHelper(handler MessageHandler) {
-	ch := make(chan error)
+func (dockerobj *AWSDOCKER) dockerobjTimeoutHelper(ctx context.Context, handler source.MessageHandler) {
+	timedOut := make(chan struct{})
+	ch := make(chan error, 1)
 	go func() {
-		ch <- dockerobj.executionHelper(handler.body(), handler.id())
+		ch <- dockerobj.executionHelper(ctx, timedOut, handler.Body(), handler.ID(), source.TaskEnvironment(handler))
 	}()
+	stopHeartbeat := startHeartbeat(handler, dockerobj.heartbeat)
+	var err error
 	select {
-	case err := <-ch:
-		if err != nil {
-			log.Printf("E: %s %s", dockerobj.containerName, err.Error())
-			handler.failure(dockerobj.result)
-		} else {
-			log.Printf("I: %s finished successfully", dockerobj.containerName)
-			handler.success()
-		}
+	case err = <-ch:
 	case <-time.After(dockerobj.timeout):
-		err := fmt.Errorf("%s timed out after %f seconds", dockerobj.containerName, dockerobj.timeout.Seconds())
-		log.Println(err)
-		handler.failure(dockerobj.result)
+		log.Printf("I: %s timed out, stopping container", dockerobj.containerName)
+		// Wait until the container is stopped, so it doesn't outlive its
+		// message
+		close(timedOut)
+		<-ch
+		dockerobj.result.SetExit("TIMEOUT")
+		err = fmt.Errorf("%s timed out after %f seconds", dockerobj.containerName, dockerobj.timeout.Seconds())
+	}
+	stopHeartbeat()
+	if err != nil {
+		log.Printf("E: %s %s", dockerobj.containerName, err.Error())
+		handler.Failure(dockerobj.result)
+	} else {
+		log.Printf("I: %s finished successfully", dockerobj.containerName)
+		handler.Success(dockerobj.output)
 	}
 }
 
-func (dockerobj *AWSDOCKER) executionHelper(messageBody *string, messageID *string) error {
+func (dockerobj *AWSDOCKER) executionHelper(ctx context.Context, timedOut <-chan struct{}, messageBody *string, messageID *string, env []string) error {
 	var err error
 
 	args := make([]string, 1)
-	env := make([]string, 1)
-	env = append(env, *messageBody)
 
 	//taskArn, err = dockerobj.startECSTask(messageBody, messageID)
 	//dockerobj.taskArn = taskArn
@@ -357,24 +374,26 @@ func (dockerobj *AWSDOCKER) executionHelper(messageBody *string, messageID *stri
 	if err != nil {
 		return err
 	}
-	err = dockerobj.monitorDocker()
+	err = dockerobj.monitorDocker(ctx, timedOut)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (dockerobj *AWSDOCKER) monitorDocker() error {
+func (dockerobj *AWSDOCKER) monitorDocker(ctx context.Context, timedOut <-chan struct{}) error {
 	dockerobj.addListener()
 	// Monitor docker events for sibling Projector task
-	status, err := dockerobj.listenForDie()
+	status, err := dockerobj.listenForDie(ctx, timedOut)
 	if err != nil {
 		return err
 	}
+	dockerobj.result.SetExit(status)
 
 	if status == "0" {
 		// status is die
 		log.Printf("[INFO] Execution completed successfully")
+		dockerobj.output = containerOutput(dockerobj.dockerClient, dockerobj.taskArn, dockerobj.containerOutputPath(), dockerobj.captureMode)
 		dockerobj.success()
 		return nil
 	}
@@ -386,10 +405,24 @@ func (dockerobj *AWSDOCKER) monitorDocker() error {
 
 }
 
-func (dockerobj *AWSDOCKER) listenForDie() (exitCode string, err error) {
+// listenForDie waits for the container to exit. It is sent SIGTERM once ctx
+// is done or timedOut is closed and SIGKILL after the grace period, its exit
+// is then SHUTDOWN or TIMEOUT unless it succeeded anyway.
+func (dockerobj *AWSDOCKER) listenForDie(ctx context.Context, timedOut <-chan struct{}) (exitCode string, err error) {
 	log.Printf("[INFO] Monitoring Docker events.")
 	log.Printf("[DEBUG] %+v\n", dockerobj)
-	timeout := time.After(dockerobj.timeout)
+	shutdown := ctx.Done()
+	var stopped string
+	var grace <-chan time.Time
+	stop := func(exit string) {
+		// Stop listening on ctx and timedOut, they stay closed
+		shutdown = nil
+		timedOut = nil
+		stopped = exit
+		grace = time.After(dockerobj.grace)
+		log.Printf("[INFO] Forwarding SIGTERM to container %s", dockerobj.taskArn)
+		dockerobj.signalContainer(docker.SIGTERM)
+	}
 	defer dockerobj.removeListener()
 	for {
 		select {
@@ -401,18 +434,40 @@ func (dockerobj *AWSDOCKER) listenForDie() (exitCode string, err error) {
 					switch msg.Action {
 					case "die":
 						log.Printf("[INFO] Container die event")
-						return msg.Actor.Attributes["exitCode"], nil
+						exitCode = msg.Actor.Attributes["exitCode"]
+						if stopped != "" && exitCode != "0" {
+							return stopped, nil
+						}
+						return exitCode, nil
 					}
 				}
 			}
-		case <-timeout:
-			log.Printf("[INFO] Instance timeout reached.")
-			err := fmt.Errorf("Docker container %s timed out after %f seconds", dockerobj.containerName, dockerobj.timeout.Seconds())
-			return "timeout", err
+		case <-shutdown:
+			stop("SHUTDOWN")
+		case <-timedOut:
+			stop("TIMEOUT")
+		case <-grace:
+			log.Printf("[ERROR] Container %s still running after %f seconds grace, killing", dockerobj.taskArn, dockerobj.grace.Seconds())
+			dockerobj.signalContainer(docker.SIGKILL)
+			return stopped, nil
 		}
 	}
 }
 
+func (dockerobj *AWSDOCKER) containerOutputPath() string {
+	if dockerobj.outputPath != "" {
+		return dockerobj.outputPath
+	}
+	return defaultContainerOutputPath
+}
+
+func (dockerobj *AWSDOCKER) signalContainer(signal docker.Signal) {
+	err := dockerobj.dockerClient.KillContainer(docker.KillContainerOptions{ID: dockerobj.taskArn, Signal: signal})
+	if err != nil {
+		log.Printf("Signal container %s (%s)", dockerobj.taskArn, err)
+	}
+}
+
 func (dockerobj *AWSDOCKER) connect(dockerEndpointPath string) {
 	log.Printf("[INFO] Connecting to Docker API.")
 	endpoint := dockerEndpointPath
@@ -1,30 +1,50 @@
 package main
 
 import (
-	"github.com/blaines/tasque-go/result"
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
 )
 
+func init() {
+	source.Register("env", source.Registration{
+		New: builtin(func(config *Config) source.MessageHandler {
+			return &ENVHandler{
+				localPayload: config.TaskPayload,
+			}
+		}),
+		Required: []string{"TASK_PAYLOAD"},
+		Detect: func(config source.Config) bool {
+			return config.Value("TASK_PAYLOAD") != ""
+		},
+	})
+}
+
 // ENVHandler hello world
 type ENVHandler struct {
 	messageID, messageBody, localPayload string
 }
 
-func (handler *ENVHandler) id() *string {
+func (handler *ENVHandler) ID() *string {
 	return &handler.messageID
 }
 
-func (handler *ENVHandler) body() *string {
+func (handler *ENVHandler) Body() *string {
 	return &handler.messageBody
 }
 
-func (handler *ENVHandler) initialize() {}
+// Attributes is nil, TASK_PAYLOAD is all there is.
+func (handler *ENVHandler) Attributes() map[string]string {
+	return nil
+}
+
+func (handler *ENVHandler) Initialize() error { return nil }
 
-func (handler *ENVHandler) receive() bool {
+func (handler *ENVHandler) Receive() (bool, error) {
 	handler.messageID = "local"
 	handler.messageBody = handler.localPayload
-	return true
+	return true, nil
 }
 
-func (handler *ENVHandler) success()                  {}
-func (handler *ENVHandler) failure(err result.Result) {}
-func (handler *ENVHandler) heartbeat()                {}
+func (handler *ENVHandler) Success(output *string)    {}
+func (handler *ENVHandler) Failure(err result.Result) {}
+func (handler *ENVHandler) Heartbeat()                {}
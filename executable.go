@@ -2,16 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/blaines/tasque-go/result"
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
 )
 
 // Executable hello world
@@ -22,40 +26,77 @@ type Executable struct {
 	stdout    bufio.Scanner
 	stderr    bufio.Scanner
 	timeout   time.Duration
+	grace     time.Duration
+	heartbeat time.Duration
 	result    result.Result
+	// captureMode and outputPath configure what is reported as the task's
+	// output, see TASK_OUTPUT_CAPTURE and TASK_OUTPUT_PATH.
+	captureMode string
+	outputPath  string
+	output      *string
 }
 
-func (executable *Executable) Execute(handler MessageHandler) {
-	executable.execute(handler)
+func (executable *Executable) Execute(ctx context.Context, handler source.MessageHandler) {
+	executable.execute(ctx, handler)
 }
 
 func (executable *Executable) Result() result.Result {
 	return executable.result
 }
 
-func (executable *Executable) execute(handler MessageHandler) {
-	handler.initialize()
-	if handler.receive() {
-		executable.executableTimeoutHelper(handler)
-	}
+func (executable *Executable) execute(ctx context.Context, handler source.MessageHandler) {
+	executable.result = result.New()
+	executable.output = nil
+	executable.executableTimeoutHelper(ctx, handler)
+}
+
+// run is the outcome of one execution of the child. Every execution gets
+// its own, so one that is given up on can't write to the next one's result.
+type run struct {
+	result result.Result
+	output *string
+	err    error
 }
 
-func (executable *Executable) executableTimeoutHelper(handler MessageHandler) {
-	ch := make(chan error)
+// killWait is how long a killed process group gets to release its output
+// pipes before the task is given up on.
+const killWait = 10 * time.Second
+
+func (executable *Executable) executableTimeoutHelper(ctx context.Context, handler source.MessageHandler) {
+	// The child is terminated when the worker shuts down or the task times
+	// out, whichever happens first
+	taskCtx, cancel := context.WithTimeout(ctx, executable.timeout)
+	defer cancel()
+	ch := make(chan *run, 1)
 	go func() {
-		ch <- executionHelper(executable.binary, executable.arguments, handler.body(), handler.id())
+		r := &run{result: result.New()}
+		r.err = executable.executionHelper(taskCtx, r, handler.Body(), handler.ID(), source.TaskEnvironment(handler))
+		ch <- r
 	}()
+	stopHeartbeat := startHeartbeat(handler, executable.heartbeat)
 	select {
-	case err := <-ch:
-		if err != nil {
-			log.Printf("E: %s %s", executable.binary, err.Error())
-			handler.failure(executable.result)
+	case r := <-ch:
+		stopHeartbeat()
+		executable.result = r.result
+		executable.output = r.output
+		if r.err != nil {
+			log.Printf("E: %s %s", executable.binary, r.err.Error())
+			if executable.result.Exit == "" {
+				executable.result.SetExit("UNKNOWN")
+			}
+			handler.Failure(executable.result)
 		} else {
 			log.Printf("I: %s finished successfully", executable.binary)
-			handler.success()
+			handler.Success(executable.output)
 		}
-	case <-time.After(executable.timeout):
-		log.Printf("E: %s timed out after %f seconds", executable.binary, executable.timeout.Seconds())
+	case <-time.After(executable.timeout + executable.grace + killWait):
+		// Only reached when something outside the process group still
+		// holds the child's output open
+		stopHeartbeat()
+		log.Printf("E: %s didn't exit after being killed, giving up", executable.binary)
+		executable.result = result.New()
+		executable.result.SetExit("TIMEOUT")
+		handler.Failure(executable.result)
 	}
 }
 
@@ -68,18 +109,49 @@ func inputPipe(pipe io.WriteCloser, inputString *string, wg *sync.WaitGroup, e *
 	}()
 }
 
-func outputPipe(pipe io.ReadCloser, annotation string, wg *sync.WaitGroup, e *error) {
+func outputPipe(pipe io.ReadCloser, annotation string, wg *sync.WaitGroup, e *error, capture *outputCapture) {
 	wg.Add(1)
 	pipeScanner := bufio.NewScanner(pipe)
 	go func() {
 		for pipeScanner.Scan() {
 			log.Printf("%s %s\n", annotation, pipeScanner.Text())
+			if capture != nil {
+				capture.scan(pipeScanner.Text())
+			}
 		}
 		wg.Done()
 	}()
 }
 
-func executionHelper(binary string, executableArguments []string, messageBody *string, messageID *string) error {
+// terminate sends SIGTERM to the child's process group once the worker shuts
+// down or the task times out, and kills it if it is still running once the
+// grace period is over.
+func (executable *Executable) terminate(ctx context.Context, process *os.Process, exited <-chan struct{}) {
+	select {
+	case <-exited:
+		return
+	case <-ctx.Done():
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("E: %s timed out after %f seconds", executable.binary, executable.timeout.Seconds())
+	}
+	log.Printf("I: Sending SIGTERM to %s (pid %d)", executable.binary, process.Pid)
+	if err := terminateProcessGroup(process); err != nil {
+		log.Printf("E: %s %s", executable.binary, err.Error())
+	}
+	select {
+	case <-exited:
+	case <-time.After(executable.grace):
+		log.Printf("E: %s still running after %f seconds grace, killing", executable.binary, executable.grace.Seconds())
+		if err := killProcessGroup(process); err != nil {
+			log.Printf("E: %s %s", executable.binary, err.Error())
+		}
+	}
+}
+
+func (executable *Executable) executionHelper(ctx context.Context, r *run, messageBody *string, messageID *string, environment []string) error {
+	binary := executable.binary
+	executableArguments := executable.arguments
 	var exitCode int
 	var err error
 	var stdinPipe io.WriteCloser
@@ -89,8 +161,18 @@ func executionHelper(binary string, executableArguments []string, messageBody *s
 	environ := os.Environ()
 	environ = append(environ, fmt.Sprintf("TASK_PAYLOAD=%s", *messageBody))
 	environ = append(environ, fmt.Sprintf("TASK_ID=%s", *messageID))
+	environ = append(environ, environment...)
+	outputPath, err := executable.prepareOutputPath()
+	if err != nil {
+		return err
+	}
+	if outputPath != "" {
+		defer os.Remove(outputPath)
+		environ = append(environ, fmt.Sprintf("TASK_OUTPUT_PATH=%s", outputPath))
+	}
 	command := exec.Command(binary, executableArguments...)
 	command.Env = environ
+	setProcessGroup(command)
 
 	if messageBody != nil {
 		if stdinPipe, err = command.StdinPipe(); err != nil {
@@ -105,19 +187,36 @@ func executionHelper(binary string, executableArguments []string, messageBody *s
 	}
 
 	if err = command.Start(); err != nil {
+		r.result.SetExit(startFailureName(err))
 		return err
 	}
+	exited := make(chan struct{})
+	defer close(exited)
+	go executable.terminate(ctx, command.Process, exited)
 
 	var wg sync.WaitGroup
+	capture := &outputCapture{}
 	inputPipe(stdinPipe, messageBody, &wg, &err)
-	outputPipe(stderrPipe, fmt.Sprintf("%s %s", *messageID, "ERROR"), &wg, &err)
-	outputPipe(stdoutPipe, fmt.Sprintf("%s", *messageID), &wg, &err)
+	outputPipe(stderrPipe, fmt.Sprintf("%s %s", *messageID, "ERROR"), &wg, &err, nil)
+	outputPipe(stdoutPipe, fmt.Sprintf("%s", *messageID), &wg, &err, capture)
 	wg.Wait()
 	if err != nil {
 		return err
 	}
 
-	if err = command.Wait(); err != nil {
+	err = command.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		// Whatever the exit, the task didn't finish in time
+		r.result.SetExit("TIMEOUT")
+		return fmt.Errorf("timed out after %f seconds", executable.timeout.Seconds())
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// Interrupted by a worker shutdown rather than a task failure
+			r.result.SetExit("SHUTDOWN")
+		} else {
+			r.result.SetExit(exitName(err))
+		}
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			exitCode = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
 			log.Printf("An error occured (%s %d)\n", binary, exitCode)
@@ -126,5 +225,95 @@ func executionHelper(binary string, executableArguments []string, messageBody *s
 		return err
 	}
 
+	r.output = executable.collectOutput(outputPath, capture)
+	return nil
+}
+
+// prepareOutputPath picks the file the task may write its output to. Unless
+// TASK_OUTPUT_PATH pins it, every task gets a fresh temporary file.
+func (executable *Executable) prepareOutputPath() (string, error) {
+	if executable.captureMode == outputNone {
+		return "", nil
+	}
+	if executable.outputPath != "" {
+		// Never report a previous task's output
+		if err := os.Remove(executable.outputPath); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		return executable.outputPath, nil
+	}
+	file, err := ioutil.TempFile("", "tasque-output-")
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	return file.Name(), nil
+}
+
+// collectOutput prefers the output file over the task's stdout.
+func (executable *Executable) collectOutput(outputPath string, capture *outputCapture) *string {
+	if outputPath != "" {
+		output, err := readOutputFile(outputPath)
+		if err != nil {
+			log.Printf("E: %s %s", executable.binary, err.Error())
+		}
+		if output != nil {
+			return output
+		}
+	}
+	if executable.captureMode == outputStdout {
+		return capture.output()
+	}
 	return nil
 }
+
+// exitName names a failed child the way the ECS path does: by its exit code,
+// or by the signal that killed it.
+func exitName(err error) string {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return "UNKNOWN"
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return "UNKNOWN"
+	}
+	if status.Signaled() {
+		return signalName(status.Signal())
+	}
+	return strconv.Itoa(status.ExitStatus())
+}
+
+// signalNames covers the signals a task is usually killed by. SIGKILL is
+// also what the OOM killer sends.
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGTERM: "SIGTERM",
+}
+
+func signalName(signal syscall.Signal) string {
+	if name, ok := signalNames[signal]; ok {
+		return name
+	}
+	return fmt.Sprintf("SIG%d", int(signal))
+}
+
+// startFailureName tells a missing binary apart from other start failures.
+func startFailureName(err error) string {
+	if execErr, ok := err.(*exec.Error); ok && execErr.Err == exec.ErrNotFound {
+		return "NOTFOUND"
+	}
+	if os.IsNotExist(err) {
+		return "NOTFOUND"
+	}
+	return "START"
+}
@@ -1,9 +1,16 @@
 package main
 
-import "github.com/blaines/tasque-go/result"
+import (
+	"context"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
+)
 
 // ExecutableInterface hello world
 type ExecutableInterface interface {
-	Execute(handler MessageHandler)
+	// Execute runs the received message. Once ctx is done the executable
+	// forwards SIGTERM to its task and waits out the shutdown grace period.
+	Execute(ctx context.Context, handler source.MessageHandler)
 	Result() result.Result
 }
@@ -0,0 +1,156 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestExecutable(script string, timeout time.Duration) *Executable {
+	return &Executable{
+		binary:      "sh",
+		arguments:   []string{"-c", script},
+		timeout:     timeout,
+		grace:       100 * time.Millisecond,
+		heartbeat:   time.Minute,
+		captureMode: outputStdout,
+	}
+}
+
+func TestExecuteSucceeds(t *testing.T) {
+	handler := &fakeHandler{}
+	executable := newTestExecutable(`echo '{"done":true}'`, 10*time.Second)
+	executable.Execute(context.Background(), handler)
+	if handler.successes != 1 || len(handler.failures) != 0 {
+		t.Fatalf("successes, failures = %d, %v, want 1, []", handler.successes, handler.failures)
+	}
+	if executable.output == nil || *executable.output != `{"done":true}` {
+		t.Errorf("output = %v, want the last stdout line", executable.output)
+	}
+}
+
+func TestExecuteTerminatesTimedOutProcessGroup(t *testing.T) {
+	for _, script := range []string{
+		"sleep 30",
+		// Ignores SIGTERM, so only the kill after the grace period ends it
+		"trap '' TERM; sleep 30 & wait",
+	} {
+		handler := &fakeHandler{}
+		executable := newTestExecutable(script, 100*time.Millisecond)
+		started := time.Now()
+		executable.Execute(context.Background(), handler)
+		if elapsed := time.Since(started); elapsed > 5*time.Second {
+			t.Errorf("%s: took %s to time out", script, elapsed)
+		}
+		if len(handler.failures) != 1 || handler.failures[0] != "TIMEOUT" {
+			t.Errorf("%s: failures = %v, want [TIMEOUT]", script, handler.failures)
+		}
+	}
+}
+
+func TestExecuteReportsShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := &fakeHandler{}
+	executable := newTestExecutable("sleep 30", 10*time.Second)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	executable.Execute(ctx, handler)
+	if len(handler.failures) != 1 || handler.failures[0] != "SHUTDOWN" {
+		t.Errorf("failures = %v, want [SHUTDOWN]", handler.failures)
+	}
+}
+
+func TestExecuteExitNames(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{"exit 3", "3"},
+		{"kill -SEGV $$", "SIGSEGV"},
+		{"kill -KILL $$", "SIGKILL"},
+		// Signals without a name are numbered
+		{"kill -USR1 $$", fmt.Sprintf("SIG%d", int(syscall.SIGUSR1))},
+	}
+	for _, test := range tests {
+		handler := &fakeHandler{}
+		newTestExecutable(test.script, 10*time.Second).Execute(context.Background(), handler)
+		if len(handler.failures) != 1 || handler.failures[0] != test.want {
+			t.Errorf("%s: failures = %v, want [%s]", test.script, handler.failures, test.want)
+		}
+	}
+}
+
+func TestExecuteStartFailureNames(t *testing.T) {
+	notExecutable := filepath.Join(t.TempDir(), "task.sh")
+	if err := ioutil.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		binary string
+		want   string
+	}{
+		{"tasque-test-no-such-binary", "NOTFOUND"},
+		{filepath.Join(t.TempDir(), "missing"), "NOTFOUND"},
+		{notExecutable, "START"},
+	}
+	for _, test := range tests {
+		handler := &fakeHandler{}
+		executable := newTestExecutable("", 10*time.Second)
+		executable.binary = test.binary
+		executable.arguments = nil
+		executable.Execute(context.Background(), handler)
+		if len(handler.failures) != 1 || handler.failures[0] != test.want {
+			t.Errorf("%s: failures = %v, want [%s]", test.binary, handler.failures, test.want)
+		}
+	}
+}
+
+func TestExecuteCapturesOutputFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		script      string
+		captureMode string
+		outputPath  string
+		want        *string
+	}{
+		{"file over stdout", `echo '{"from":"stdout"}'; echo '{"from":"file"}' > "$TASK_OUTPUT_PATH"`, outputStdout, "", stringPointer(`{"from":"file"}`)},
+		{"stdout without a file", `echo '{"from":"stdout"}'`, outputStdout, "", stringPointer(`{"from":"stdout"}`)},
+		{"file only", `echo '{"from":"stdout"}'; echo '{"from":"file"}' > "$TASK_OUTPUT_PATH"`, outputFile, "", stringPointer(`{"from":"file"}`)},
+		{"file mode ignores stdout", `echo '{"from":"stdout"}'`, outputFile, "", nil},
+		{"pinned path", `echo '{"from":"file"}' > "$TASK_OUTPUT_PATH"`, outputFile, filepath.Join(t.TempDir(), "output.json"), stringPointer(`{"from":"file"}`)},
+		{"none", `echo '{"from":"stdout"}'; echo '{"from":"file"}' > "${TASK_OUTPUT_PATH:-/dev/null}"`, outputNone, "", nil},
+	}
+	for _, test := range tests {
+		handler := &fakeHandler{}
+		executable := newTestExecutable(test.script, 10*time.Second)
+		executable.captureMode = test.captureMode
+		executable.outputPath = test.outputPath
+		executable.Execute(context.Background(), handler)
+		if handler.successes != 1 {
+			t.Errorf("%s: failures = %v, want a success", test.name, handler.failures)
+		}
+		if !equalOutput(executable.output, test.want) {
+			t.Errorf("%s: output = %v, want %v", test.name, executable.output, test.want)
+		}
+	}
+}
+
+func TestExecuteIgnoresPreviousOutputFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.json")
+	if err := ioutil.WriteFile(path, []byte(`{"from":"previous"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	executable := newTestExecutable("true", 10*time.Second)
+	executable.captureMode = outputFile
+	executable.outputPath = path
+	executable.Execute(context.Background(), &fakeHandler{})
+	if executable.output != nil {
+		t.Errorf("output = %s, want nil, the task wrote none", *executable.output)
+	}
+}
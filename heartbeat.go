@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/Skycatch/tasque-go/source"
+)
+
+// startHeartbeat calls handler.Heartbeat every interval while a task runs.
+// The returned function stops the ticker and only returns once no heartbeat
+// is in flight, so it is safe to call Success or Failure right after it.
+func startHeartbeat(handler source.MessageHandler, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case t := <-ticker.C:
+				handler.Heartbeat()
+				log.Println("Heartbeat", t)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
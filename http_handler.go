@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
+)
+
+func init() {
+	source.Register("http", source.Registration{
+		New: builtin(func(config *Config) source.MessageHandler {
+			return &HTTPHandler{
+				server: sharedTaskServer(config.Value("TASK_HTTP_ADDR"), config.Int("TASK_HTTP_QUEUE_SIZE"), config.Duration("TASK_HTTP_RETENTION"), int64(config.Int("TASK_HTTP_MAX_BODY"))),
+			}
+		}),
+		Settings: []source.Setting{
+			{Name: "TASK_HTTP_ADDR", Usage: "Address to accept tasks on, POST /tasks and GET /tasks/{id}"},
+			{Name: "TASK_HTTP_QUEUE_SIZE", Default: "100", Usage: "Accepted tasks waiting for a worker before POST /tasks is refused"},
+			{Name: "TASK_HTTP_RETENTION", Default: "1h", Usage: "How long finished tasks can be looked up"},
+			{Name: "TASK_HTTP_MAX_BODY", Default: "1048576", Usage: "Largest payload in bytes POST /tasks accepts, 0 for no limit"},
+		},
+		Required: []string{"TASK_HTTP_ADDR"},
+		Detect: func(config source.Config) bool {
+			return config.Value("TASK_HTTP_ADDR") != ""
+		},
+		// Without TASK_CONCURRENCY a single worker serves requests until
+		// tasque is stopped
+		Daemon: true,
+	})
+}
+
+const (
+	taskQueued    = "queued"
+	taskRunning   = "running"
+	taskSucceeded = "succeeded"
+	taskFailed    = "failed"
+)
+
+// httpTask is what GET /tasks/{id} returns.
+type httpTask struct {
+	ID       string             `json:"id"`
+	Status   string             `json:"status"`
+	Output   *string            `json:"output,omitempty"`
+	Result   *source.TaskResult `json:"result,omitempty"`
+	Created  time.Time          `json:"created"`
+	Started  *time.Time         `json:"started,omitempty"`
+	Finished *time.Time         `json:"finished,omitempty"`
+	payload  string
+	done     chan struct{}
+}
+
+// taskServer accepts tasks over HTTP and hands them to the workers. All
+// workers share one server, tasks are only kept in memory. Once tasque shuts
+// down new tasks are refused, and the server stops when the last worker
+// closed its handler.
+type taskServer struct {
+	addr      string
+	listening sync.Once
+	listenErr error
+	http      *http.Server
+	mu        sync.Mutex
+	tasks     map[string]*httpTask
+	queue     chan *httpTask
+	retention time.Duration
+	// maxBody limits the posted payloads, 0 accepts any size
+	maxBody int64
+	// workers counts the initialized handlers, closing is set on shutdown
+	workers int
+	closing bool
+}
+
+var (
+	taskServerOnce sync.Once
+	taskServerInst *taskServer
+)
+
+// sharedTaskServer creates the server the first time a worker's handler is
+// built. It starts listening on Initialize.
+func sharedTaskServer(addr string, queueSize int, retention time.Duration, maxBody int64) *taskServer {
+	taskServerOnce.Do(func() {
+		taskServerInst = &taskServer{
+			addr:      addr,
+			tasks:     map[string]*httpTask{},
+			queue:     make(chan *httpTask, queueSize),
+			retention: retention,
+			maxBody:   maxBody,
+		}
+	})
+	return taskServerInst
+}
+
+// listen binds addr once, every worker gets the same error. POST /tasks is
+// refused once ctx is canceled.
+func (server *taskServer) listen(ctx context.Context) error {
+	server.listening.Do(func() {
+		listener, err := net.Listen("tcp", server.addr)
+		if err != nil {
+			server.listenErr = err
+			return
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/tasks", server.create)
+		mux.HandleFunc("/tasks/", server.get)
+		// The bound address, in case addr left the port to the system
+		server.addr = listener.Addr().String()
+		server.http = &http.Server{Handler: mux}
+		go func() {
+			if err := server.http.Serve(listener); err != http.ErrServerClosed {
+				log.Println("E: ", err.Error())
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			server.mu.Lock()
+			server.closing = true
+			server.mu.Unlock()
+		}()
+		log.Printf("I: Accepting tasks on %s", server.addr)
+	})
+	if server.listenErr != nil {
+		return server.listenErr
+	}
+	server.mu.Lock()
+	server.workers++
+	server.mu.Unlock()
+	return nil
+}
+
+// close stops the server once the last worker closed its handler. Tasks
+// still queued fail with SHUTDOWN, requests waiting for them are answered
+// before the server stops.
+func (server *taskServer) close() {
+	server.mu.Lock()
+	server.closing = true
+	server.workers--
+	if server.workers > 0 {
+		server.mu.Unlock()
+		return
+	}
+	var queued []*httpTask
+	for drained := false; !drained; {
+		select {
+		case task := <-server.queue:
+			queued = append(queued, task)
+		default:
+			drained = true
+		}
+	}
+	server.mu.Unlock()
+	r := result.New()
+	r.SetExit("SHUTDOWN")
+	for _, task := range queued {
+		server.finish(task, taskFailed, nil, source.NewTaskResult(r))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.http.Shutdown(ctx); err != nil {
+		log.Println("E: ", err.Error())
+	}
+}
+
+// create handles POST /tasks, the request body is the payload. The task is
+// run asynchronously unless ?wait= gives a duration to wait for it.
+func (server *taskServer) create(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		if wait, err = time.ParseDuration(value); err != nil {
+			http.Error(w, "wait: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	reader := r.Body
+	if server.maxBody > 0 {
+		reader = http.MaxBytesReader(w, r.Body, server.maxBody)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		status := http.StatusBadRequest
+		// MaxBytesReader fails once the limit is read
+		if server.maxBody > 0 && int64(len(body)) >= server.maxBody {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	task := &httpTask{
+		ID:      newTaskID(),
+		Status:  taskQueued,
+		Created: time.Now().UTC(),
+		payload: string(body),
+		done:    make(chan struct{}),
+	}
+	// Queued under mu, so close can't miss a task accepted while it drains
+	server.mu.Lock()
+	if server.closing {
+		server.mu.Unlock()
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case server.queue <- task:
+		server.prune()
+		server.tasks[task.ID] = task
+		server.mu.Unlock()
+	default:
+		server.mu.Unlock()
+		http.Error(w, "too many queued tasks", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Location", "/tasks/"+task.ID)
+	if wait > 0 {
+		select {
+		case <-task.done:
+			server.write(w, task, http.StatusOK)
+			return
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	server.write(w, task, http.StatusAccepted)
+}
+
+// get handles GET /tasks/{id}.
+func (server *taskServer) get(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	server.mu.Lock()
+	task, ok := server.tasks[strings.TrimPrefix(r.URL.Path, "/tasks/")]
+	server.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	server.write(w, task, http.StatusOK)
+}
+
+func (server *taskServer) write(w http.ResponseWriter, task *httpTask, status int) {
+	server.mu.Lock()
+	body, err := json.Marshal(task)
+	server.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// prune forgets tasks that finished more than retention ago, mu is held.
+func (server *taskServer) prune() {
+	for id, task := range server.tasks {
+		if task.Finished != nil && time.Since(*task.Finished) > server.retention {
+			delete(server.tasks, id)
+		}
+	}
+}
+
+// finish records the outcome of a task and releases requests waiting on it.
+func (server *taskServer) finish(task *httpTask, status string, output *string, err *source.TaskResult) {
+	now := time.Now().UTC()
+	server.mu.Lock()
+	task.Status = status
+	task.Output = output
+	task.Result = err
+	task.Finished = &now
+	server.mu.Unlock()
+	close(task.done)
+}
+
+func newTaskID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// HTTPHandler runs the tasks posted to its worker's shared taskServer.
+type HTTPHandler struct {
+	server      *taskServer
+	task        *httpTask
+	messageID   string
+	messageBody string
+	// ctx is canceled when the worker shuts down, which ends the wait for a
+	// task
+	ctx context.Context
+}
+
+func (handler *HTTPHandler) ID() *string {
+	return &handler.messageID
+}
+
+func (handler *HTTPHandler) Body() *string {
+	return &handler.messageBody
+}
+
+// Attributes is nil, a posted task is only its payload.
+func (handler *HTTPHandler) Attributes() map[string]string {
+	return nil
+}
+
+// SetContext makes Receive return once the worker shuts down.
+func (handler *HTTPHandler) SetContext(ctx context.Context) {
+	handler.ctx = ctx
+}
+
+func (handler *HTTPHandler) Initialize() error {
+	if handler.ctx == nil {
+		handler.ctx = context.Background()
+	}
+	return handler.server.listen(handler.ctx)
+}
+
+func (handler *HTTPHandler) Receive() (bool, error) {
+	select {
+	case task := <-handler.server.queue:
+		now := time.Now().UTC()
+		handler.server.mu.Lock()
+		task.Status = taskRunning
+		task.Started = &now
+		handler.server.mu.Unlock()
+		handler.task = task
+		handler.messageID = task.ID
+		handler.messageBody = task.payload
+		return true, nil
+	case <-time.After(20 * time.Second):
+		return false, nil
+	case <-handler.ctx.Done():
+		return false, nil
+	}
+}
+
+func (handler *HTTPHandler) Success(output *string) {
+	handler.server.finish(handler.task, taskSucceeded, output, nil)
+}
+
+func (handler *HTTPHandler) Failure(err result.Result) {
+	handler.server.finish(handler.task, taskFailed, nil, source.NewTaskResult(err))
+}
+
+// Heartbeat does nothing, tasks live in this process.
+func (handler *HTTPHandler) Heartbeat() {}
+
+// Close stops the server after the last worker.
+func (handler *HTTPHandler) Close() {
+	handler.server.close()
+}
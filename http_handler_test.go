@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postTask posts payload, the task is only decoded for a 2xx status
+func postTask(t *testing.T, server *taskServer, payload string) (int, httpTask, string) {
+	t.Helper()
+	response, err := http.Post("http://"+server.addr+"/tasks", "application/json", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var task httpTask
+	if response.StatusCode < 300 {
+		if err := json.Unmarshal(body, &task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response.StatusCode, task, strings.TrimSpace(string(body))
+}
+
+func TestHTTPHandler(t *testing.T) {
+	server := &taskServer{
+		addr:      "127.0.0.1:0",
+		tasks:     map[string]*httpTask{},
+		queue:     make(chan *httpTask, 1),
+		retention: time.Hour,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := &HTTPHandler{server: server}
+	handler.SetContext(ctx)
+	if err := handler.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, first, _ := postTask(t, server, `{"n":1}`)
+	if status != http.StatusAccepted || first.Status != taskQueued {
+		t.Fatalf("POST /tasks = %d with %s, want 202 queued", status, first.Status)
+	}
+	if status, _, message := postTask(t, server, `{"n":2}`); status != http.StatusServiceUnavailable {
+		t.Errorf("POST /tasks with a full queue = %d %s, want 503", status, message)
+	}
+	if received, err := handler.Receive(); !received || err != nil || *handler.Body() != `{"n":1}` {
+		t.Fatalf("Receive() = %t, %v with %s, want the posted task", received, err, *handler.Body())
+	}
+	output := `{"done":true}`
+	handler.Success(&output)
+
+	response, err := http.Get("http://" + server.addr + "/tasks/" + first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	var finished httpTask
+	if err := json.Unmarshal(body, &finished); err != nil {
+		t.Fatal(err)
+	}
+	if finished.Status != taskSucceeded || finished.Output == nil || *finished.Output != output {
+		t.Errorf("GET /tasks/%s = %s", first.ID, body)
+	}
+
+	status, queued, _ := postTask(t, server, `{"n":3}`)
+	if status != http.StatusAccepted {
+		t.Fatalf("POST /tasks = %d, want 202", status)
+	}
+	cancel()
+	// The shutdown reaches the server asynchronously, until then the full
+	// queue refuses the task
+	message := ""
+	for deadline := time.Now().Add(5 * time.Second); message != "shutting down" && time.Now().Before(deadline); {
+		status, _, message = postTask(t, server, `{"n":4}`)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status != http.StatusServiceUnavailable || message != "shutting down" {
+		t.Errorf("POST /tasks during shutdown = %d %s, want 503 shutting down", status, message)
+	}
+
+	handler.Close()
+	server.mu.Lock()
+	task := server.tasks[queued.ID]
+	server.mu.Unlock()
+	if task.Status != taskFailed || task.Result == nil || task.Result.Exit != "SHUTDOWN" {
+		t.Errorf("task queued at shutdown = %s with %+v, want failed with SHUTDOWN", task.Status, task.Result)
+	}
+	if _, err := http.Get("http://" + server.addr + "/tasks/" + first.ID); err == nil {
+		t.Error("server still answering after the last handler closed")
+	}
+	started := time.Now()
+	if received, _ := handler.Receive(); received || time.Since(started) > 5*time.Second {
+		t.Errorf("Receive() = %t after %s, want false right away after shutdown", received, time.Since(started))
+	}
+}
+
+func TestHTTPHandlerLimitsPayloads(t *testing.T) {
+	server := &taskServer{
+		addr:      "127.0.0.1:0",
+		tasks:     map[string]*httpTask{},
+		queue:     make(chan *httpTask, 2),
+		retention: time.Hour,
+		maxBody:   8,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := &HTTPHandler{server: server}
+	handler.SetContext(ctx)
+	if err := handler.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+
+	if status, _, message := postTask(t, server, `{"n":12}`); status != http.StatusAccepted {
+		t.Errorf("POST /tasks with 8 bytes = %d %s, want 202", status, message)
+	}
+	if status, _, _ := postTask(t, server, `{"n":123}`); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST /tasks with 9 bytes = %d, want 413", status)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.tasks) != 1 {
+		t.Errorf("%d tasks accepted, want 1", len(server.tasks))
+	}
+}
+
+func TestHTTPHandlerReportsListenErrors(t *testing.T) {
+	server := &taskServer{addr: "127.0.0.1:-1", tasks: map[string]*httpTask{}, queue: make(chan *httpTask, 1)}
+	for i := 0; i < 2; i++ {
+		if err := (&HTTPHandler{server: server}).Initialize(); err == nil {
+			t.Errorf("Initialize() of worker %d = nil, want the listen error", i)
+		}
+	}
+}
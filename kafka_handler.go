@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
+	"github.com/segmentio/kafka-go"
+)
+
+func init() {
+	source.Register("kafka", source.Registration{
+		New: builtin(func(config *Config) source.MessageHandler {
+			handler := &KafkaHandler{
+				topic:           config.Value("KAFKA_TOPIC"),
+				group:           config.Value("KAFKA_GROUP"),
+				retryTopic:      config.Value("KAFKA_RETRY_TOPIC"),
+				deadLetterTopic: config.Value("KAFKA_DEAD_LETTER_TOPIC"),
+				retryBackoff:    config.RetryBackoff,
+				retryBackoffMax: config.RetryBackoffMax,
+				maxAttempts:     config.MaxAttempts,
+			}
+			for _, broker := range strings.Split(config.Value("KAFKA_BROKERS"), ",") {
+				if broker = strings.TrimSpace(broker); broker != "" {
+					handler.brokers = append(handler.brokers, broker)
+				}
+			}
+			return handler
+		}),
+		Settings: []source.Setting{
+			{Name: "KAFKA_BROKERS", Usage: "Kafka brokers to receive from, comma separated host:port"},
+			{Name: "KAFKA_TOPIC", Usage: "Kafka topic to consume"},
+			{Name: "KAFKA_GROUP", Default: "tasque", Usage: "Consumer group every worker joins"},
+			{Name: "KAFKA_RETRY_TOPIC", Usage: "Topic failed messages are published to for another attempt"},
+			{Name: "KAFKA_DEAD_LETTER_TOPIC", Usage: "Topic for messages that failed TASK_MAX_ATTEMPTS times"},
+		},
+		Required: []string{"KAFKA_BROKERS", "KAFKA_TOPIC"},
+		Detect: func(config source.Config) bool {
+			return config.Value("KAFKA_BROKERS") != ""
+		},
+	})
+}
+
+// kafkaAttemptsHeader counts the attempts of a message republished to the
+// retry topic, named like the SQS dead letter attribute.
+const kafkaAttemptsHeader = "TaskReceiveCount"
+
+// KafkaHandler consumes a topic as a member of a consumer group. Every worker
+// joins the group on its own and processes the partitions assigned to it in
+// order, so committing a message's offset after it finished never skips a
+// message another worker is still running.
+type KafkaHandler struct {
+	reader       *kafka.Reader
+	writer       *kafka.Writer
+	message      kafka.Message
+	messageID    string
+	messageBody  string
+	receiveCount int
+	brokers      []string
+	topic        string
+	group        string
+	// Failed messages are published to retryTopic until they were attempted
+	// maxAttempts times, then to deadLetterTopic. Without retryTopic the
+	// partition is read again from the failed message after retryBackoff
+	// until then.
+	retryTopic      string
+	deadLetterTopic string
+	retryBackoff    time.Duration
+	retryBackoffMax time.Duration
+	maxAttempts     int
+	// After a rewind the group is rejoined at resumeAt, rewinds counts the
+	// attempts of rewoundID.
+	resumeAt  time.Time
+	rewoundID string
+	rewinds   int
+	// ctx is canceled when the worker shuts down, which ends a fetch or the
+	// wait before rejoining
+	ctx context.Context
+}
+
+func (handler *KafkaHandler) ID() *string {
+	return &handler.messageID
+}
+
+func (handler *KafkaHandler) Body() *string {
+	return &handler.messageBody
+}
+
+// SetContext makes Receive return once the worker shuts down.
+func (handler *KafkaHandler) SetContext(ctx context.Context) {
+	handler.ctx = ctx
+}
+
+func (handler *KafkaHandler) Initialize() error {
+	if handler.ctx == nil {
+		handler.ctx = context.Background()
+	}
+	handler.join()
+	if handler.retryTopic != "" || handler.deadLetterTopic != "" {
+		handler.writer = &kafka.Writer{
+			Addr: kafka.TCP(handler.brokers...),
+			// Keep messages with the same key in order on the retry topic
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		}
+	}
+	return nil
+}
+
+// join creates a group member that starts after the last committed offset of
+// each partition it is assigned.
+func (handler *KafkaHandler) join() {
+	handler.reader = kafka.NewReader(kafka.ReaderConfig{
+		Brokers: handler.brokers,
+		GroupID: handler.group,
+		Topic:   handler.topic,
+		// Only commit what CommitMessages is called with, synchronously
+		CommitInterval: 0,
+	})
+}
+
+func (handler *KafkaHandler) Receive() (bool, error) {
+	if handler.reader == nil {
+		if wait := time.Until(handler.resumeAt); wait > 0 {
+			// Return to the worker loop regularly so shutdown isn't delayed
+			if wait > 20*time.Second {
+				wait = 20 * time.Second
+			}
+			source.Sleep(handler.ctx, wait)
+			return false, nil
+		}
+		handler.join()
+	}
+	ctx, cancel := context.WithTimeout(handler.ctx, 20*time.Second)
+	defer cancel()
+	message, err := handler.reader.FetchMessage(ctx)
+	if handler.ctx.Err() != nil {
+		return false, nil
+	}
+	if err == context.DeadlineExceeded {
+		log.Println("I: ", "No messages retrieved from topic")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	handler.message = message
+	handler.messageBody = string(message.Value)
+	handler.messageID = kafkaMessageID(message)
+	handler.receiveCount = 1
+	for _, header := range message.Headers {
+		if header.Key == kafkaAttemptsHeader {
+			attempts, _ := strconv.Atoi(string(header.Value))
+			handler.receiveCount = attempts + 1
+		}
+	}
+	if handler.messageID == handler.rewoundID {
+		handler.receiveCount += handler.rewinds
+	}
+	return true, nil
+}
+
+// kafkaMessageID is topic/partition/offset/key. Keys are arbitrary bytes, hex
+// keeps the ID printable.
+func kafkaMessageID(message kafka.Message) string {
+	return fmt.Sprintf("%s/%d/%d/%s", message.Topic, message.Partition, message.Offset, hex.EncodeToString(message.Key))
+}
+
+// Attributes are the message's headers, including those tasque added when it
+// republished the message.
+func (handler *KafkaHandler) Attributes() map[string]string {
+	attributes := map[string]string{}
+	for _, header := range handler.message.Headers {
+		attributes[header.Key] = string(header.Value)
+	}
+	return attributes
+}
+
+// Environment tells the task how often the message was attempted.
+func (handler *KafkaHandler) Environment() map[string]string {
+	return map[string]string{"TASK_RECEIVE_COUNT": strconv.Itoa(handler.receiveCount)}
+}
+
+func (handler *KafkaHandler) Success(output *string) {
+	handler.commit()
+}
+
+func (handler *KafkaHandler) commit() {
+	if err := handler.reader.CommitMessages(context.Background(), handler.message); err != nil {
+		log.Printf("E: Couldn't commit message %s %s", handler.messageID, err.Error())
+	}
+}
+
+func (handler *KafkaHandler) Failure(err result.Result) {
+	if err.Exit == "SHUTDOWN" {
+		// Left uncommitted, the partition's next owner starts with it
+		return
+	}
+	topic := handler.failureTopic()
+	if topic == "" {
+		handler.rewind()
+		return
+	}
+	log.Printf("I: Message %s failed %d times, sending to %s", handler.messageID, handler.receiveCount, topic)
+	if publishError := handler.publish(topic, err); publishError != nil {
+		log.Printf("E: Couldn't send message %s to %s %s", handler.messageID, topic, publishError.Error())
+		handler.rewind()
+		return
+	}
+	handler.commit()
+}
+
+// failureTopic is the topic a failed message is published to: deadLetterTopic
+// once it was attempted maxAttempts times, retryTopic before. Empty when the
+// partition is read again from the message instead.
+func (handler *KafkaHandler) failureTopic() string {
+	if handler.deadLetterTopic != "" && handler.maxAttempts > 0 && handler.receiveCount >= handler.maxAttempts {
+		return handler.deadLetterTopic
+	}
+	return handler.retryTopic
+}
+
+// publish copies the message to topic with its failure reason as headers.
+func (handler *KafkaHandler) publish(topic string, err result.Result) error {
+	headers := []kafka.Header{
+		{Key: "TaskSourceMessageId", Value: []byte(handler.messageID)},
+		{Key: kafkaAttemptsHeader, Value: []byte(strconv.Itoa(handler.receiveCount))},
+		{Key: "TaskErrorMessage", Value: []byte(err.Message())},
+		{Key: "TaskExit", Value: []byte(err.Exit)},
+		{Key: "TaskError", Value: []byte(err.Error)},
+	}
+	for _, header := range handler.message.Headers {
+		if header.Key != kafkaAttemptsHeader {
+			headers = append(headers, header)
+		}
+	}
+	return handler.writer.WriteMessages(context.Background(), kafka.Message{
+		Topic:   topic,
+		Key:     handler.message.Key,
+		Value:   handler.message.Value,
+		Headers: headers,
+	})
+}
+
+// rewind leaves the group and rejoins it after retryBackoff. Messages
+// fetched after the failed one are dropped uncommitted, so the partition is
+// read again from the failed message.
+func (handler *KafkaHandler) rewind() {
+	if handler.messageID == handler.rewoundID {
+		handler.rewinds++
+	} else {
+		handler.rewoundID = handler.messageID
+		handler.rewinds = 1
+	}
+	backoff := source.RetryBackoff(handler.retryBackoff, handler.retryBackoffMax, handler.receiveCount)
+	log.Printf("I: Message %s retried in %s", handler.messageID, backoff)
+	if err := handler.reader.Close(); err != nil {
+		log.Println("E: ", err.Error())
+	}
+	handler.reader = nil
+	handler.resumeAt = time.Now().Add(backoff)
+}
+
+// Heartbeat does nothing, the reader heartbeats the consumer group on its
+// own for as long as a task runs.
+func (handler *KafkaHandler) Heartbeat() {}
+
+// Close leaves the group and closes the writer.
+func (handler *KafkaHandler) Close() {
+	if handler.reader != nil {
+		if err := handler.reader.Close(); err != nil {
+			log.Println("E: ", err.Error())
+		}
+	}
+	if handler.writer != nil {
+		if err := handler.writer.Close(); err != nil {
+			log.Println("E: ", err.Error())
+		}
+	}
+}
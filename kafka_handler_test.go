@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaFailureTopic(t *testing.T) {
+	tests := []struct {
+		retryTopic      string
+		deadLetterTopic string
+		maxAttempts     int
+		receiveCount    int
+		want            string
+	}{
+		{"", "", 3, 3, ""},
+		{"retry", "", 3, 1, "retry"},
+		{"retry", "", 3, 3, "retry"},
+		{"retry", "dead", 3, 2, "retry"},
+		{"retry", "dead", 3, 3, "dead"},
+		{"retry", "dead", 0, 10, "retry"},
+		// Rewound until the last attempt
+		{"", "dead", 3, 1, ""},
+		{"", "dead", 3, 2, ""},
+		{"", "dead", 3, 3, "dead"},
+		{"", "dead", 3, 4, "dead"},
+		{"", "dead", 0, 10, ""},
+	}
+	for _, test := range tests {
+		handler := &KafkaHandler{
+			retryTopic:      test.retryTopic,
+			deadLetterTopic: test.deadLetterTopic,
+			maxAttempts:     test.maxAttempts,
+			receiveCount:    test.receiveCount,
+		}
+		if got := handler.failureTopic(); got != test.want {
+			t.Errorf("failureTopic() with retry %q, dead letter %q, attempt %d of %d = %q, want %q",
+				test.retryTopic, test.deadLetterTopic, test.receiveCount, test.maxAttempts, got, test.want)
+		}
+	}
+}
+
+func TestKafkaMessageID(t *testing.T) {
+	tests := []struct {
+		message kafka.Message
+		want    string
+	}{
+		{kafka.Message{Topic: "tasks", Partition: 2, Offset: 42, Key: []byte("job-1")}, "tasks/2/42/6a6f622d31"},
+		{kafka.Message{Topic: "tasks", Partition: 0, Offset: 7}, "tasks/0/7/"},
+		{kafka.Message{Topic: "tasks", Partition: 1, Offset: 0, Key: []byte{0x00, 0xff, '/'}}, "tasks/1/0/00ff2f"},
+	}
+	for _, test := range tests {
+		if got := kafkaMessageID(test.message); got != test.want {
+			t.Errorf("kafkaMessageID(%v) = %q, want %q", test.message, got, test.want)
+		}
+	}
+}
@@ -1,198 +1,201 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"os"
-	"strings"
-	"time"
 
-	"encoding/json"
-
-	"github.com/aws/aws-sdk-go/aws"
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
 )
 
 // Tasque hello world
 type Tasque struct {
-	Handler    MessageHandler
-	Executable ExecutableInterface
+	// NewExecutable builds the executable for one worker. Every worker gets
+	// its own so that concurrent executions never share result state.
+	NewExecutable func(worker int) ExecutableInterface
+	Concurrency   int
+	MaxMessages   int
+	Daemon        bool
+	config        *Config
+	// registration is the selected source, it builds every worker's handler
+	registration source.Registration
+	claimed      int64
+	processed    int64
 }
 
 func main() {
-	var taskDefinition *string
-	var overridePayloadKey *string
-	var dockerPayloadKey string
-	var overrideContainerName *string
-	var dockerEndpointPath string
-	var deployMethod *string
+	command, args := splitCommand(os.Args[1:])
+	if command == "version" {
+		printVersion(os.Stdout)
+		return
+	}
+	config, arguments, err := loadConfig(args)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	isDocker := os.Getenv("DOCKER")
-	if isDocker != "" {
-		log.Println("Docker mode")
-		// Docker Mode
-		tasque := Tasque{}
-		// DEPLOY_METHOD:  Curerntly it's ECS by default can be switched to DOCKER
-		deployMethod = aws.String(os.Getenv("DEPLOY_METHOD"))
-		if *deployMethod == "" {
-			*deployMethod = "ECS"
+	switch command {
+	case "config":
+		configCommand(config, arguments)
+	case "validate":
+		validateCommand(config)
+	case "worker":
+		config.Docker = true
+		runWorker(config)
+	case "run":
+		config.Docker = false
+		runCommand(config, arguments)
+	default:
+		// No subcommand, DOCKER picks the mode like it always has
+		if config.Docker {
+			runWorker(config)
+		} else {
+			runCommand(config, arguments)
 		}
+	}
+}
 
-		switch strings.ToUpper(*deployMethod) {
-		case "DOCKER":
-			// DOCKER_CONTAINER_NAME
-			overrideContainerName = aws.String(os.Getenv("DOCKER_CONTAINER_NAME"))
-			if *overrideContainerName == "" {
-				panic("Environment variable DOCKER_CONTAINER_NAME not set")
-			}
-			// DOCKER_TASK_DEFINITION
-			taskDefinition = aws.String(os.Getenv("DOCKER_TASK_DEFINITION"))
-			if *taskDefinition == "" {
-				panic("Environment variable DOCKER_TASK_DEFINITION not set")
-			}
-
-			// DOCKER_ENDPOINT
-			dockerEndpointPath = os.Getenv("DOCKER_ENDPOINT")
-			if dockerEndpointPath == "" {
-				dockerEndpointPath = "unix:///var/run/docker.sock"
-			}
-			// OVERRIDE_PAYLOAD_KEY
-			dockerPayloadKey = os.Getenv("TASK_PAYLOAD")
-
-			overrideTaskDefinition := DockerTaskDefinition{}
-			json.Unmarshal([]byte(*taskDefinition), &overrideTaskDefinition)
-
+// runWorker starts tasks as sibling containers on ECS, docker or EKS.
+func runWorker(config *Config) {
+	mustValidate(config)
+	log.Println("Docker mode")
+	// Docker Mode
+	tasque := newTasque(config)
+	// DEPLOY_METHOD:  Curerntly it's ECS by default can be switched to DOCKER
+	switch config.DeployMethod {
+	case "DOCKER":
+		tasque.NewExecutable = func(worker int) ExecutableInterface {
 			d := &AWSDOCKER{
-				containerName:        *overrideContainerName,
-				timeout:              getTimeout(),
-				containerArgs:        dockerPayloadKey,
-				dockerTaskDefinition: overrideTaskDefinition,
-			}
-			d.connect(dockerEndpointPath)
-			tasque.Executable = d
-			tasque.runWithTimeout()
-		case "EKS":
-			kubeConfigPath := os.Getenv("KUBE_CONFIG_PATH")
-			dockerImage := os.Getenv("VW_DOCKER_IMAGE")
-			if dockerImage == "" {
-				panic("Environment variable VW_DOCKER_IMAGE not set")
+				containerName:        workerContainerName(config.DockerContainerName, worker, tasque.Concurrency),
+				timeout:              config.Timeout,
+				grace:                config.ShutdownGrace,
+				heartbeat:            config.Heartbeat,
+				captureMode:          config.OutputCapture,
+				outputPath:           config.OutputPath,
+				containerArgs:        config.TaskPayload,
+				dockerTaskDefinition: config.DockerTaskDefinition,
+				authData:             config.DockerAuthData,
 			}
-			tasque.Executable = &AWSEKS{
-				DockerImage:    dockerImage,
-				KubeConfigPath: kubeConfigPath,
-			}
-			tasque.runWithTimeout()
-		case "ECS":
-			// ECS_TASK_DEFINITION
-			taskDefinition = aws.String(os.Getenv("ECS_TASK_DEFINITION"))
-			if *taskDefinition == "" {
-				panic("Environment variable ECS_TASK_DEFINITION not set")
-			}
-			// ECS_CONTAINER_NAME
-			overrideContainerName = aws.String(os.Getenv("ECS_CONTAINER_NAME"))
-			if *overrideContainerName == "" {
-				panic("Environment variable ECS_CONTAINER_NAME not set")
-			}
-			// DOCKER_ENDPOINT
-			dockerEndpointPath = os.Getenv("DOCKER_ENDPOINT")
-			if dockerEndpointPath == "" {
-				dockerEndpointPath = "unix:///var/run/docker.sock"
+			d.connect(config.DockerEndpoint)
+			return d
+		}
+	case "EKS":
+		tasque.NewExecutable = func(worker int) ExecutableInterface {
+			return &AWSEKS{
+				DockerImage:       config.EKSDockerImage,
+				KubeConfigPath:    config.KubeConfigPath,
+				HeartbeatDuration: config.Heartbeat,
 			}
-			// OVERRIDE_PAYLOAD_KEY
-			overridePayloadKey = aws.String("TASK_PAYLOAD")
-			// DEPLOY_METHOD:  Curerntly it's ECS by default can be switched to DOCKER
+		}
+	case "ECS":
+		tasque.NewExecutable = func(worker int) ExecutableInterface {
+			// Each worker listens on its own events channel
 			d := &Docker{}
-			d.connect(dockerEndpointPath)
-			tasque.Executable = &AWSECS{
+			d.connect(config.DockerEndpoint)
+			return &AWSECS{
 				docker:                d,
-				ecsTaskDefinition:     taskDefinition,
-				overrideContainerName: overrideContainerName,
-				overridePayloadKey:    overridePayloadKey,
-				timeout:               getTimeout(),
+				ecsTaskDefinition:     &config.ECSTaskDefinition,
+				overrideContainerName: &config.ECSContainerName,
+				overridePayloadKey:    &payloadKey,
+				timeout:               config.Timeout,
+				grace:                 config.ShutdownGrace,
+				heartbeatDuration:     config.Heartbeat,
+				captureMode:           config.OutputCapture,
+				outputPath:            config.OutputPath,
 			}
-			tasque.runWithTimeout()
-		default:
-			log.Panicf("Unknown or no deployment method provided: %s", *deployMethod)
-		}
-	} else {
-		// CLI Mode
-		arguments := os.Args[1:]
-		if len(os.Args) > 1 {
-			tasque := Tasque{}
-			tasque.Executable = &Executable{
-				binary:    arguments[0],
-				arguments: arguments[1:],
-				timeout:   getTimeout(),
-			}
-			tasque.runWithTimeout()
-		} else {
-			log.Println("Expecting tasque to be run with an application")
-			log.Println("Usage: tasque npm start")
 		}
 	}
+	tasque.runWithTimeout()
 }
 
-func (tasque *Tasque) getHandler() {
-	var handler MessageHandler
-	taskPayload := os.Getenv("TASK_PAYLOAD")
-	taskQueueURL := os.Getenv("TASK_QUEUE_URL")
-	activityARN := os.Getenv("TASK_ACTIVITY_ARN")
-	if taskPayload != "" {
-		handler = &ENVHandler{}
-	} else if taskQueueURL != "" {
-		handler = &SQSHandler{}
-	} else if activityARN != "" {
-		handler = &SFNHandler{
-			activityARN: activityARN,
+// runCommand runs arguments as a child process for every message.
+func runCommand(config *Config, arguments []string) {
+	if len(arguments) == 0 {
+		log.Println("Expecting tasque to be run with an application")
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	mustValidate(config)
+	// CLI Mode
+	tasque := newTasque(config)
+	tasque.NewExecutable = func(worker int) ExecutableInterface {
+		return &Executable{
+			binary:      arguments[0],
+			arguments:   arguments[1:],
+			timeout:     config.Timeout,
+			grace:       config.ShutdownGrace,
+			heartbeat:   config.Heartbeat,
+			captureMode: config.OutputCapture,
+			outputPath:  config.OutputPath,
 		}
-	} else {
-		panic("No handler")
 	}
-	tasque.Handler = handler
+	tasque.runWithTimeout()
 }
 
-func (tasque *Tasque) runWithTimeout() {
-	tasque.getHandler()
-	// Commented code is for potential future "daemon"
-	// var wg sync.WaitGroup
-	// for i := 0; i < 5; i++ {
-	// 	wg.Add(1)
-	// 	go func() {
-	// 		defer wg.Done()
-	// 		for i := 0; i < 5; i++ {
-	tasque.Executable.Execute(tasque.Handler)
-	// 		}
-	// 	}()
-	// }
-	// wg.Wait()
+// mustValidate exits listing every configuration problem.
+func mustValidate(config *Config) {
+	if err := config.validate(); err != nil {
+		log.Fatal(err)
+	}
+	result.Configure(config.ExitTranslations, config.ErrorMessageTemplate)
 }
 
-func getTimeout() time.Duration {
-	taskTimeout := os.Getenv("TASK_TIMEOUT")
-	if taskTimeout == "" {
-		log.Println("Default timeout: 30s")
-		timeout, _ := time.ParseDuration("30s")
-		return timeout
+// payloadKey is the environment variable ECS tasks receive the payload in
+var payloadKey = "TASK_PAYLOAD"
+
+// newTasque reads the worker settings. Without TASK_CONCURRENCY tasque keeps
+// its original behaviour: a single worker handling at most one message.
+func newTasque(config *Config) *Tasque {
+	tasque := &Tasque{
+		Concurrency: 1,
+		MaxMessages: 1,
+		config:      config,
 	}
-	timeout, err := time.ParseDuration(taskTimeout)
-	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
-		return time.Duration(0)
+	if config.Concurrency > 0 {
+		tasque.Daemon = true
+		tasque.Concurrency = config.Concurrency
+		tasque.MaxMessages = config.MaxMessages
 	}
-	return timeout
+	return tasque
 }
 
-func getHeartbeatTime() time.Duration {
-	taskTimeout := os.Getenv("TASK_HEARTBEAT")
-	if taskTimeout == "" {
-		log.Println("Default timeout: 30s")
-		timeout, _ := time.ParseDuration("30s")
-		return timeout
-	}
-	timeout, err := time.ParseDuration(taskTimeout)
+// getHandler builds a handler for one worker from the selected source.
+func (tasque *Tasque) getHandler() source.MessageHandler {
+	return tasque.registration.New(tasque.config)
+}
+
+func (tasque *Tasque) runWithTimeout() {
+	name, registration, err := source.Select(tasque.config)
 	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
-		return time.Duration(0)
+		log.Fatal(err)
+	}
+	tasque.registration = registration
+	if name == "env" && tasque.Daemon {
+		// A TASK_PAYLOAD is a single message, looping would rerun it forever
+		log.Println("I: TASK_PAYLOAD set, ignoring TASK_CONCURRENCY")
+		tasque.Daemon = false
+		tasque.Concurrency = 1
+		tasque.MaxMessages = 1
+	}
+	if registration.Daemon && !tasque.Daemon {
+		tasque.Daemon = true
+		tasque.MaxMessages = tasque.config.MaxMessages
+	}
+	if err := tasque.runWorkers(); err != nil {
+		log.Fatalf("E: Couldn't %s", err.Error())
+	}
+}
+
+// workerContainerName keeps container names unique when several workers
+// share one docker daemon.
+func workerContainerName(name string, worker int, concurrency int) string {
+	if concurrency <= 1 {
+		return name
 	}
-	return timeout
+	return fmt.Sprintf("%s-%d", name, worker)
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
+	"github.com/nats-io/nats.go"
+)
+
+func init() {
+	source.Register("nats", source.Registration{
+		New: builtin(func(config *Config) source.MessageHandler {
+			handler := &NATSHandler{
+				url:               config.Value("NATS_URL"),
+				stream:            config.Value("NATS_STREAM"),
+				subject:           config.Value("NATS_SUBJECT"),
+				consumer:          config.Value("NATS_CONSUMER"),
+				visibilityTimeout: config.VisibilityTimeout,
+				retryBackoff:      config.RetryBackoff,
+				retryBackoffMax:   config.RetryBackoffMax,
+				maxAttempts:       config.MaxAttempts,
+				termExits:         map[string]bool{},
+			}
+			for _, exit := range strings.Split(config.Value("NATS_TERM_EXITS"), ",") {
+				if exit = strings.TrimSpace(exit); exit != "" {
+					handler.termExits[exit] = true
+				}
+			}
+			return handler
+		}),
+		Settings: []source.Setting{
+			{Name: "NATS_URL", Usage: "NATS servers to receive from, comma separated", Secret: true},
+			{Name: "NATS_STREAM", Usage: "JetStream stream to receive from"},
+			{Name: "NATS_SUBJECT", Usage: "Subject filter of the consumer, the whole stream when unset"},
+			{Name: "NATS_CONSUMER", Default: "tasque", Usage: "Durable pull consumer, created when missing"},
+			{Name: "NATS_TERM_EXITS", Usage: "Comma separated exits that terminate a failed message instead of retrying it"},
+		},
+		Required: []string{"NATS_URL", "NATS_STREAM"},
+		Detect: func(config source.Config) bool {
+			return config.Value("NATS_URL") != ""
+		},
+	})
+}
+
+// NATSHandler fetches messages from a JetStream durable pull consumer. The
+// ack wait is TASK_VISIBILITY_TIMEOUT and every heartbeat restarts it, like
+// SFNHandler heartbeats an activity.
+type NATSHandler struct {
+	connection   *nats.Conn
+	subscription *nats.Subscription
+	message      *nats.Msg
+	messageID    string
+	messageBody  string
+	receiveCount int
+	url          string
+	stream       string
+	subject      string
+	consumer     string
+	// A message is redelivered when it wasn't acknowledged or heartbeated
+	// for visibilityTimeout.
+	visibilityTimeout time.Duration
+	// Failed messages are redelivered after retryBackoff, doubling with
+	// every delivery up to retryBackoffMax.
+	retryBackoff    time.Duration
+	retryBackoffMax time.Duration
+	// Failures with an exit in termExits or after maxAttempts deliveries are
+	// terminated and never redelivered.
+	maxAttempts int
+	termExits   map[string]bool
+}
+
+func (handler *NATSHandler) ID() *string {
+	return &handler.messageID
+}
+
+func (handler *NATSHandler) Body() *string {
+	return &handler.messageBody
+}
+
+func (handler *NATSHandler) Initialize() error {
+	var err error
+	handler.connection, err = nats.Connect(handler.url, nats.MaxReconnects(-1))
+	if err != nil {
+		return err
+	}
+	js, err := handler.connection.JetStream()
+	if err != nil {
+		return err
+	}
+	options := []nats.SubOpt{nats.Bind(handler.stream, handler.consumer)}
+	if _, err = js.ConsumerInfo(handler.stream, handler.consumer); err == nats.ErrConsumerNotFound {
+		// An existing consumer keeps its own settings
+		options = []nats.SubOpt{
+			nats.BindStream(handler.stream),
+			nats.AckExplicit(),
+			nats.AckWait(handler.visibilityTimeout),
+		}
+	} else if err != nil {
+		return err
+	}
+	handler.subscription, err = js.PullSubscribe(handler.subject, handler.consumer, options...)
+	return err
+}
+
+func (handler *NATSHandler) Receive() (bool, error) {
+	messages, err := handler.subscription.Fetch(1, nats.MaxWait(20*time.Second))
+	if err == nats.ErrTimeout || (err == nil && len(messages) == 0) {
+		log.Println("I: ", "No messages retrieved from stream")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	handler.message = messages[0]
+	handler.messageBody = string(handler.message.Data)
+	handler.messageID = handler.message.Subject
+	handler.receiveCount = 1
+	if metadata, err := handler.message.Metadata(); err == nil {
+		handler.messageID = fmt.Sprintf("%s/%d", metadata.Stream, metadata.Sequence.Stream)
+		handler.receiveCount = int(metadata.NumDelivered)
+	}
+	return true, nil
+}
+
+// Attributes are the message's headers, repeated ones comma separated.
+func (handler *NATSHandler) Attributes() map[string]string {
+	attributes := map[string]string{}
+	for name, values := range handler.message.Header {
+		attributes[name] = strings.Join(values, ",")
+	}
+	return attributes
+}
+
+// Environment tells the task how often the message was delivered.
+func (handler *NATSHandler) Environment() map[string]string {
+	return map[string]string{"TASK_RECEIVE_COUNT": strconv.Itoa(handler.receiveCount)}
+}
+
+func (handler *NATSHandler) Success(output *string) {
+	if err := handler.message.AckSync(); err != nil {
+		log.Printf("E: Couldn't acknowledge message %s %s", handler.messageID, err.Error())
+	}
+}
+
+func (handler *NATSHandler) Failure(err result.Result) {
+	var ackError error
+	switch {
+	case err.Exit == "SHUTDOWN":
+		// A Nak without delay redelivers to the next Fetch of any worker.
+		// The delivery still counts toward TASK_MAX_ATTEMPTS.
+		log.Printf("I: Message %s redelivered now", handler.messageID)
+		ackError = handler.message.Nak()
+	case handler.termExits[err.Exit] || (handler.maxAttempts > 0 && handler.receiveCount >= handler.maxAttempts):
+		log.Printf("I: Message %s failed %d times with %s, terminating", handler.messageID, handler.receiveCount, err.Exit)
+		ackError = handler.message.Term()
+	default:
+		backoff := source.RetryBackoff(handler.retryBackoff, handler.retryBackoffMax, handler.receiveCount)
+		log.Printf("I: Message %s redelivered in %s", handler.messageID, backoff)
+		ackError = handler.message.NakWithDelay(backoff)
+	}
+	if ackError == nil {
+		// Naks aren't confirmed, make sure it is sent before tasque exits
+		ackError = handler.connection.Flush()
+	}
+	if ackError != nil {
+		log.Printf("E: Couldn't reject message %s %s", handler.messageID, ackError.Error())
+	}
+}
+
+func (handler *NATSHandler) Heartbeat() {
+	if err := handler.message.InProgress(); err != nil {
+		log.Printf("E: Couldn't heartbeat message %s %s", handler.messageID, err.Error())
+	}
+}
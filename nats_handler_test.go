@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/nats-io/nats.go"
+)
+
+// TestNATSHandler runs against the JetStream enabled server at
+// TASQUE_TEST_NATS_URL, e.g. one started with nats-server -js.
+func TestNATSHandler(t *testing.T) {
+	url := os.Getenv("TASQUE_TEST_NATS_URL")
+	if url == "" {
+		t.Skip("TASQUE_TEST_NATS_URL not set")
+	}
+	connection, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	js, err := connection.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := fmt.Sprintf("tasque_test_%d", time.Now().UnixNano())
+	if _, err = js.AddStream(&nats.StreamConfig{Name: stream, Subjects: []string{stream + ".>"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer js.DeleteStream(stream)
+	if _, err = js.Publish(stream+".task", []byte(`{"hello":"world"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &NATSHandler{
+		url:               url,
+		stream:            stream,
+		consumer:          "tasque",
+		visibilityTimeout: time.Minute,
+		retryBackoff:      10 * time.Millisecond,
+		retryBackoffMax:   10 * time.Millisecond,
+		termExits:         map[string]bool{},
+	}
+	if err := handler.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer handler.connection.Close()
+
+	if received, err := handler.Receive(); !received || err != nil {
+		t.Fatalf("Receive() = %t, %v, want the published message", received, err)
+	}
+	if *handler.Body() != `{"hello":"world"}` || handler.receiveCount != 1 {
+		t.Errorf("Body, receiveCount = %s, %d", *handler.Body(), handler.receiveCount)
+	}
+	handler.Heartbeat()
+	failure := result.New()
+	failure.SetExit("1")
+	handler.Failure(failure)
+
+	if received, err := handler.Receive(); !received || err != nil {
+		t.Fatalf("Receive() = %t, %v, want the failed message again", received, err)
+	}
+	if handler.receiveCount != 2 || handler.Environment()["TASK_RECEIVE_COUNT"] != "2" {
+		t.Errorf("receiveCount = %d, want 2", handler.receiveCount)
+	}
+	handler.Success(nil)
+
+	info, err := js.ConsumerInfo(stream, "tasque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NumAckPending != 0 || info.NumPending != 0 {
+		t.Errorf("NumAckPending, NumPending = %d, %d, want 0 after the acknowledgement", info.NumAckPending, info.NumPending)
+	}
+}
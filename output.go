@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Output capture modes, see TASK_OUTPUT_CAPTURE
+const (
+	// outputFile only reports what the task writes to TASK_OUTPUT_PATH
+	outputFile = "file"
+	// outputStdout falls back to the last JSON line the task printed
+	outputStdout = "stdout"
+	// outputNone never reports task output
+	outputNone = "none"
+)
+
+// defaultContainerOutputPath is where containerized tasks are told to write
+// their output unless TASK_OUTPUT_PATH says otherwise.
+const defaultContainerOutputPath = "/tmp/tasque-output.json"
+
+// outputCapture remembers the last JSON object or array printed by a task.
+// It is fed from the goroutines draining the task's stdout.
+type outputCapture struct {
+	mu   sync.Mutex
+	last *string
+}
+
+func (capture *outputCapture) scan(line string) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") && !strings.HasPrefix(line, "[") {
+		return
+	}
+	if !json.Valid([]byte(line)) {
+		return
+	}
+	capture.mu.Lock()
+	capture.last = &line
+	capture.mu.Unlock()
+}
+
+func (capture *outputCapture) output() *string {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	return capture.last
+}
+
+// readOutputFile returns the content of the task's output file, or nil when
+// the task didn't write one.
+func readOutputFile(path string) (*string, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nonEmpty(content), nil
+}
+
+// readOutputTar returns the first file of a tar stream, which is what docker
+// hands back when copying a file out of a container.
+func readOutputTar(stream io.Reader) (*string, error) {
+	archive := tar.NewReader(stream)
+	if _, err := archive.Next(); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(archive)
+	if err != nil {
+		return nil, err
+	}
+	return nonEmpty(content), nil
+}
+
+// containerOutput collects the output of a stopped container, preferring its
+// output file over its stdout.
+func containerOutput(client *docker.Client, containerID string, path string, captureMode string) *string {
+	if captureMode == outputNone {
+		return nil
+	}
+	var archive bytes.Buffer
+	err := client.DownloadFromContainer(containerID, docker.DownloadFromContainerOptions{
+		Path:         path,
+		OutputStream: &archive,
+	})
+	if err == nil {
+		output, err := readOutputTar(&archive)
+		if err != nil {
+			log.Printf("[ERROR] Couldn't read output of container %s %s", containerID, err.Error())
+		}
+		if output != nil {
+			return output
+		}
+	} else if dockerErr, ok := err.(*docker.Error); !ok || dockerErr.Status != http.StatusNotFound {
+		log.Printf("[ERROR] Couldn't copy output from container %s %s", containerID, err.Error())
+	}
+	if captureMode != outputStdout {
+		return nil
+	}
+	var logs bytes.Buffer
+	err = client.Logs(docker.LogsOptions{
+		Container:    containerID,
+		OutputStream: &logs,
+		Stdout:       true,
+		Tail:         "100",
+	})
+	if err != nil {
+		log.Printf("[ERROR] Couldn't read logs of container %s %s", containerID, err.Error())
+		return nil
+	}
+	capture := &outputCapture{}
+	scanner := bufio.NewScanner(&logs)
+	for scanner.Scan() {
+		capture.scan(scanner.Text())
+	}
+	return capture.output()
+}
+
+func nonEmpty(content []byte) *string {
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 {
+		return nil
+	}
+	output := string(content)
+	return &output
+}
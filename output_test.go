@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// outputTar is what docker returns when copying a file of content out of a
+// container
+func outputTar(t *testing.T, content string) []byte {
+	t.Helper()
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	if err := writer.WriteHeader(&tar.Header{Name: "tasque-output.json", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestOutputCaptureKeepsLastJSONLine(t *testing.T) {
+	capture := &outputCapture{}
+	for _, line := range []string{
+		`starting`,
+		`{"progress":1}`,
+		`  ["a","b"]  `,
+		`{"truncated":`,
+		`done {"not":"alone"}`,
+	} {
+		capture.scan(line)
+	}
+	if output := capture.output(); output == nil || *output != `["a","b"]` {
+		t.Errorf("output() = %v, want the last complete JSON line", output)
+	}
+}
+
+func TestReadOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content *string
+		want    *string
+	}{
+		{nil, nil},
+		{stringPointer(" \n"), nil},
+		{stringPointer("{\"done\":true}\n"), stringPointer(`{"done":true}`)},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, "output.json")
+		if test.content != nil {
+			if err := ioutil.WriteFile(path, []byte(*test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		output, err := readOutputFile(path)
+		if err != nil || !equalOutput(output, test.want) {
+			t.Errorf("%d: readOutputFile() = %v, %v, want %v", i, output, err, test.want)
+		}
+	}
+}
+
+func TestReadOutputTar(t *testing.T) {
+	output, err := readOutputTar(bytes.NewReader(outputTar(t, "{\"done\":true}\n")))
+	if err != nil || !equalOutput(output, stringPointer(`{"done":true}`)) {
+		t.Errorf("readOutputTar() = %v, %v, want the file's content", output, err)
+	}
+	if output, err := readOutputTar(bytes.NewReader(outputTar(t, ""))); err != nil || output != nil {
+		t.Errorf("readOutputTar() of an empty file = %v, %v, want nil", output, err)
+	}
+	if _, err := readOutputTar(strings.NewReader("")); err == nil {
+		t.Error("readOutputTar() of an empty stream succeeded")
+	}
+}
+
+// fakeDockerOutput serves a container's output file, 404 when archive is
+// nil, and its logs as a multiplexed stdout stream
+func fakeDockerOutput(t *testing.T, archive []byte, logs string) (*docker.Client, *int) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch {
+		case r.URL.Path == "/containers/task/archive":
+			if archive == nil {
+				http.Error(w, "Could not find the file", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-tar")
+			w.Write(archive)
+		case r.URL.Path == "/containers/task/logs":
+			w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+			header := make([]byte, 8)
+			header[0] = 1
+			binary.BigEndian.PutUint32(header[4:], uint32(len(logs)))
+			w.Write(append(header, logs...))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, &calls
+}
+
+func TestContainerOutput(t *testing.T) {
+	logs := "starting\n{\"from\":\"stdout\"}\ndone\n"
+	tests := []struct {
+		name        string
+		archive     []byte
+		captureMode string
+		want        *string
+	}{
+		{"output file", outputTar(t, `{"from":"file"}`), outputStdout, stringPointer(`{"from":"file"}`)},
+		{"output file only", outputTar(t, `{"from":"file"}`), outputFile, stringPointer(`{"from":"file"}`)},
+		{"empty output file", outputTar(t, ""), outputStdout, stringPointer(`{"from":"stdout"}`)},
+		{"no output file", nil, outputStdout, stringPointer(`{"from":"stdout"}`)},
+		{"no output file without stdout", nil, outputFile, nil},
+	}
+	for _, test := range tests {
+		client, _ := fakeDockerOutput(t, test.archive, logs)
+		output := containerOutput(client, "task", defaultContainerOutputPath, test.captureMode)
+		if !equalOutput(output, test.want) {
+			t.Errorf("%s: containerOutput() = %v, want %v", test.name, output, test.want)
+		}
+	}
+
+	client, calls := fakeDockerOutput(t, outputTar(t, `{"from":"file"}`), logs)
+	if output := containerOutput(client, "task", defaultContainerOutputPath, outputNone); output != nil || *calls != 0 {
+		t.Errorf("containerOutput() = %v with %d docker calls, want nil without asking docker", output, *calls)
+	}
+}
+
+func stringPointer(s string) *string {
+	return &s
+}
+
+func equalOutput(output *string, want *string) bool {
+	if output == nil || want == nil {
+		return output == want
+	}
+	return *output == *want
+}
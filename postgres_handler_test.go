@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
+)
+
+// TestPostgresHandler runs against the database at
+// TASQUE_TEST_POSTGRES_URL in a table of its own that it drops again.
+func TestPostgresHandler(t *testing.T) {
+	url := os.Getenv("TASQUE_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TASQUE_TEST_POSTGRES_URL not set")
+	}
+	handler := &PostgresHandler{
+		url:          url,
+		table:        fmt.Sprintf("tasque_test_%d", time.Now().UnixNano()),
+		queue:        "default",
+		migrate:      true,
+		pollInterval: 10 * time.Millisecond,
+		worker:       source.ConsumerName("test"),
+		lease:        time.Minute,
+	}
+	if err := handler.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer handler.db.Close()
+	defer handler.db.Exec("DROP TABLE " + handler.table)
+
+	_, err := handler.db.Exec(fmt.Sprintf(`INSERT INTO %s (payload) VALUES ($1)`, handler.table), `{"hello":"world"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received, err := handler.Receive(); !received || err != nil {
+		t.Fatalf("Receive() = %t, %v, want the inserted job", received, err)
+	}
+	if *handler.Body() != `{"hello":"world"}` || handler.receiveCount != 1 {
+		t.Errorf("Body, receiveCount = %s, %d", *handler.Body(), handler.receiveCount)
+	}
+	handler.Heartbeat()
+	failure := result.New()
+	failure.SetExit("1")
+	handler.Failure(failure)
+
+	if received, err := handler.Receive(); !received || err != nil {
+		t.Fatalf("Receive() = %t, %v, want the failed job again", received, err)
+	}
+	if handler.receiveCount != 2 {
+		t.Errorf("receiveCount = %d, want 2", handler.receiveCount)
+	}
+	output := `{"done":true}`
+	handler.Success(&output)
+
+	var status string
+	var stored sql.NullString
+	err = handler.db.QueryRow(fmt.Sprintf(`SELECT status, output FROM %s WHERE id = $1`, handler.table), handler.messageID).Scan(&status, &stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "succeeded" || stored.String != output {
+		t.Errorf("status, output = %s, %s, want succeeded, %s", status, stored.String, output)
+	}
+
+	// A shutdown releases the job, still counting the attempt
+	_, err = handler.db.Exec(fmt.Sprintf(`INSERT INTO %s (payload) VALUES ($1)`, handler.table), `{"hello":"again"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received, err := handler.Receive(); !received || err != nil {
+		t.Fatalf("Receive() = %t, %v, want the second job", received, err)
+	}
+	shutdown := result.New()
+	shutdown.SetExit("SHUTDOWN")
+	handler.Failure(shutdown)
+	if received, err := handler.Receive(); !received || err != nil {
+		t.Fatalf("Receive() = %t, %v, want the released job again", received, err)
+	}
+	if handler.receiveCount != 2 {
+		t.Errorf("receiveCount = %d after a shutdown, want 2", handler.receiveCount)
+	}
+
+	// Another worker took over the lease
+	_, err = handler.db.Exec(fmt.Sprintf(`UPDATE %s SET locked_by = 'other' WHERE id = $1`, handler.table), handler.messageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.Heartbeat()
+	select {
+	case <-handler.Abandoned():
+	default:
+		t.Fatal("not abandoned after another worker took over the lease")
+	}
+	handler.Success(&output)
+	var lockedBy sql.NullString
+	err = handler.db.QueryRow(fmt.Sprintf(`SELECT status, locked_by FROM %s WHERE id = $1`, handler.table), handler.messageID).Scan(&status, &lockedBy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "running" || lockedBy.String != "other" {
+		t.Errorf("status, locked_by = %s, %s, want the job left running for the other worker", status, lockedBy.String)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op, windows has no process groups to join.
+func setProcessGroup(command *exec.Cmd) {}
+
+// terminateProcessGroup kills the child, windows cannot deliver SIGTERM.
+func terminateProcessGroup(process *os.Process) error {
+	return process.Kill()
+}
+
+// killProcessGroup kills the child.
+func killProcessGroup(process *os.Process) error {
+	return process.Kill()
+}
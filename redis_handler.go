@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
+	"github.com/go-redis/redis"
+)
+
+func init() {
+	source.Register("redis", source.Registration{
+		New: builtin(func(config *Config) source.MessageHandler {
+			handler := &RedisHandler{
+				url:              config.Value("TASK_REDIS_URL"),
+				stream:           config.Value("TASK_REDIS_STREAM"),
+				group:            config.Value("TASK_REDIS_GROUP"),
+				consumer:         source.ConsumerName(config.Value("TASK_REDIS_CONSUMER")),
+				claimIdle:        config.Duration("TASK_REDIS_CLAIM_IDLE"),
+				maxAttempts:      config.MaxAttempts,
+				deadLetterStream: config.Value("TASK_REDIS_DEAD_LETTER_STREAM"),
+			}
+			if handler.claimIdle == 0 {
+				// Heartbeats reset the idle time, survive one missed heartbeat
+				handler.claimIdle = 2 * config.Heartbeat
+			}
+			if handler.url != "" {
+				if _, err := redis.ParseURL(handler.url); err != nil {
+					config.Invalid("TASK_REDIS_URL", err.Error())
+				}
+			}
+			return handler
+		}),
+		Settings: []source.Setting{
+			{Name: "TASK_REDIS_URL", Usage: "Redis to receive from, redis://[:password@]host:port/db", Secret: true},
+			{Name: "TASK_REDIS_STREAM", Usage: "Redis stream to receive from"},
+			{Name: "TASK_REDIS_GROUP", Default: "tasque", Usage: "Consumer group of TASK_REDIS_STREAM, created when missing"},
+			{Name: "TASK_REDIS_CONSUMER", Usage: "Consumer name prefix, the hostname when unset"},
+			{Name: "TASK_REDIS_CLAIM_IDLE", Usage: "Idle time after which another consumer's entry is claimed, twice TASK_HEARTBEAT when unset"},
+			{Name: "TASK_REDIS_DEAD_LETTER_STREAM", Usage: "Redis stream for entries that failed TASK_MAX_ATTEMPTS times"},
+		},
+		Required: []string{"TASK_REDIS_URL", "TASK_REDIS_STREAM"},
+		Detect: func(config source.Config) bool {
+			return config.Value("TASK_REDIS_URL") != ""
+		},
+	})
+}
+
+// redisPayloadField is the stream entry field holding the message body.
+// Entries without it are passed to the task as a JSON object of all fields.
+const redisPayloadField = "payload"
+
+// redisPendingPage is how many pending entries claim reads per XPENDING.
+const redisPendingPage = 100
+
+// RedisHandler receives entries of a Redis stream through a consumer group,
+// every worker reads as its own consumer. An entry stays pending until it is
+// acknowledged on success. Failed entries and entries of crashed consumers
+// are claimed by the next receive once they have been idle for claimIdle.
+type RedisHandler struct {
+	client       *redis.Client
+	messageID    string
+	messageBody  string
+	receiveCount int64
+	fields       map[string]interface{}
+	url          string
+	stream       string
+	group        string
+	consumer     string
+	// Pending entries idle this long are claimed, heartbeats keep a running
+	// entry's idle time below it.
+	claimIdle time.Duration
+	// After maxAttempts deliveries a failed entry is moved to
+	// deadLetterStream instead of being retried.
+	maxAttempts      int
+	deadLetterStream string
+	// abandoned is closed once a heartbeat found the current entry claimed
+	// by another consumer.
+	abandoned chan struct{}
+}
+
+func (handler *RedisHandler) ID() *string {
+	return &handler.messageID
+}
+
+func (handler *RedisHandler) Body() *string {
+	return &handler.messageBody
+}
+
+// Attributes are the entry's fields besides the payload.
+func (handler *RedisHandler) Attributes() map[string]string {
+	attributes := map[string]string{}
+	for name, value := range handler.fields {
+		if name != redisPayloadField {
+			attributes[name] = fmt.Sprint(value)
+		}
+	}
+	return attributes
+}
+
+// Environment tells the task how often the entry was delivered.
+func (handler *RedisHandler) Environment() map[string]string {
+	return map[string]string{"TASK_RECEIVE_COUNT": strconv.FormatInt(handler.receiveCount, 10)}
+}
+
+func (handler *RedisHandler) Initialize() error {
+	options, err := redis.ParseURL(handler.url)
+	if err != nil {
+		return err
+	}
+	handler.client = redis.NewClient(options)
+	err = handler.client.XGroupCreateMkStream(handler.stream, handler.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+func (handler *RedisHandler) Receive() (bool, error) {
+	if claimed, err := handler.claim(); claimed || err != nil {
+		return claimed, err
+	}
+	streams, err := handler.client.XReadGroup(&redis.XReadGroupArgs{
+		Group:    handler.group,
+		Consumer: handler.consumer,
+		Streams:  []string{handler.stream, ">"},
+		Count:    1,
+		Block:    20 * time.Second,
+	}).Result()
+	if err == redis.Nil || (err == nil && (len(streams) == 0 || len(streams[0].Messages) == 0)) {
+		log.Println("I: ", "No messages retrieved from stream")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	handler.setMessage(streams[0].Messages[0], 1)
+	return true, nil
+}
+
+// claim takes over the oldest pending entry that has been idle for
+// claimIdle, left behind by a failure or a consumer that died. The pending
+// entries are read a page at a time until one is claimed.
+func (handler *RedisHandler) claim() (bool, error) {
+	start := "-"
+	for {
+		pending, err := handler.client.XPendingExt(&redis.XPendingExtArgs{
+			Stream: handler.stream,
+			Group:  handler.group,
+			Start:  start,
+			End:    "+",
+			Count:  redisPendingPage,
+		}).Result()
+		if err != nil {
+			return false, err
+		}
+		for _, entry := range pending {
+			if entry.Idle < handler.claimIdle {
+				continue
+			}
+			messages, err := handler.client.XClaim(&redis.XClaimArgs{
+				Stream:   handler.stream,
+				Group:    handler.group,
+				Consumer: handler.consumer,
+				MinIdle:  handler.claimIdle,
+				Messages: []string{entry.Id},
+			}).Result()
+			if err != nil {
+				return false, err
+			}
+			if len(messages) == 0 {
+				// Claimed by another consumer in the meantime
+				continue
+			}
+			log.Printf("I: Claimed message %s from %s, idle for %s", entry.Id, entry.Consumer, entry.Idle)
+			// XCLAIM counts as another delivery
+			handler.setMessage(messages[0], entry.RetryCount+1)
+			return true, nil
+		}
+		if len(pending) < redisPendingPage {
+			return false, nil
+		}
+		next, ok := nextStreamID(pending[len(pending)-1].Id)
+		if !ok {
+			return false, nil
+		}
+		start = next
+	}
+}
+
+// nextStreamID is the first ID after id, XPENDING ranges include their start.
+func nextStreamID(id string) (string, bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	sequence, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || sequence == math.MaxUint64 {
+		return "", false
+	}
+	return parts[0] + "-" + strconv.FormatUint(sequence+1, 10), true
+}
+
+func (handler *RedisHandler) setMessage(message redis.XMessage, receiveCount int64) {
+	handler.messageID = message.ID
+	handler.receiveCount = receiveCount
+	handler.fields = message.Values
+	handler.abandoned = make(chan struct{})
+	if payload, ok := message.Values[redisPayloadField].(string); ok {
+		handler.messageBody = payload
+		return
+	}
+	body, _ := json.Marshal(message.Values)
+	handler.messageBody = string(body)
+}
+
+// Success acknowledges the entry unless it was abandoned. Acknowledgements
+// are per group, so that would end the run of the consumer that claimed it.
+func (handler *RedisHandler) Success(output *string) {
+	if handler.isAbandoned() {
+		log.Printf("I: Not acknowledging message %s, it was claimed by another consumer", handler.messageID)
+		return
+	}
+	handler.ack()
+}
+
+func (handler *RedisHandler) ack() {
+	if err := handler.client.XAck(handler.stream, handler.group, handler.messageID).Err(); err != nil {
+		log.Printf("E: Couldn't acknowledge message %s %s", handler.messageID, err.Error())
+	}
+}
+
+// Failure leaves the entry pending, it is retried by whichever consumer
+// claims it after claimIdle. An abandoned entry belongs to another consumer.
+// An entry released on shutdown didn't fail and is never dead lettered.
+func (handler *RedisHandler) Failure(err result.Result) {
+	if handler.isAbandoned() {
+		log.Printf("I: Not failing message %s, it was claimed by another consumer", handler.messageID)
+		return
+	}
+	if err.Exit == "SHUTDOWN" {
+		log.Printf("I: Message %s pending, claimed by another consumer after %s", handler.messageID, handler.claimIdle)
+		return
+	}
+	if handler.deadLetterStream != "" && handler.maxAttempts > 0 && handler.receiveCount >= int64(handler.maxAttempts) {
+		deadLetterError := handler.deadLetter(err)
+		if deadLetterError == nil {
+			return
+		}
+		log.Printf("E: Couldn't dead letter message %s %s", handler.messageID, deadLetterError.Error())
+	}
+	log.Printf("I: Message %s pending, retried after %s", handler.messageID, handler.claimIdle)
+}
+
+// Heartbeat reclaims the entry for this consumer, which resets its idle time
+// without counting as a delivery. An entry that another consumer claimed
+// after a missed heartbeat is left to it and abandoned here.
+func (handler *RedisHandler) Heartbeat() {
+	if handler.isAbandoned() {
+		return
+	}
+	pending, err := handler.client.XPendingExt(&redis.XPendingExtArgs{
+		Stream:   handler.stream,
+		Group:    handler.group,
+		Start:    handler.messageID,
+		End:      handler.messageID,
+		Count:    1,
+		Consumer: handler.consumer,
+	}).Result()
+	if err != nil {
+		log.Printf("E: Couldn't heartbeat message %s %s", handler.messageID, err.Error())
+		return
+	}
+	if len(pending) == 0 {
+		log.Printf("E: Message %s was claimed by another consumer, abandoning it", handler.messageID)
+		close(handler.abandoned)
+		return
+	}
+	err = handler.client.XClaimJustID(&redis.XClaimArgs{
+		Stream:   handler.stream,
+		Group:    handler.group,
+		Consumer: handler.consumer,
+		Messages: []string{handler.messageID},
+	}).Err()
+	if err != nil {
+		log.Printf("E: Couldn't heartbeat message %s %s", handler.messageID, err.Error())
+	}
+}
+
+// Abandoned is closed once a heartbeat found the current entry claimed by
+// another consumer.
+func (handler *RedisHandler) Abandoned() <-chan struct{} {
+	return handler.abandoned
+}
+
+func (handler *RedisHandler) isAbandoned() bool {
+	select {
+	case <-handler.abandoned:
+		return true
+	default:
+		return false
+	}
+}
+
+// deadLetter adds the entry with its failure reason to the dead letter
+// stream and acknowledges it.
+func (handler *RedisHandler) deadLetter(err result.Result) error {
+	log.Printf("I: Message %s failed %d times, sending to %s", handler.messageID, handler.receiveCount, handler.deadLetterStream)
+	addError := handler.client.XAdd(&redis.XAddArgs{
+		Stream: handler.deadLetterStream,
+		Values: map[string]interface{}{
+			redisPayloadField:     handler.messageBody,
+			"TaskSourceMessageId": handler.messageID,
+			"TaskReceiveCount":    handler.receiveCount,
+			"TaskErrorMessage":    err.Message(),
+			"TaskExit":            err.Exit,
+			"TaskError":           err.Error,
+		},
+	}).Err()
+	if addError != nil {
+		return addError
+	}
+	handler.ack()
+	return nil
+}
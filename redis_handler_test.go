@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/go-redis/redis"
+)
+
+func TestNextStreamID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+		ok   bool
+	}{
+		{"1526919030474-55", "1526919030474-56", true},
+		{"0-0", "0-1", true},
+		{"1526919030474-18446744073709551615", "", false},
+		{"1526919030474", "", false},
+	}
+	for _, test := range tests {
+		got, ok := nextStreamID(test.id)
+		if got != test.want || ok != test.ok {
+			t.Errorf("nextStreamID(%q) = %q, %t, want %q, %t", test.id, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+// TestRedisHandler runs against the Redis at TASQUE_TEST_REDIS_URL, e.g.
+// redis://localhost:6379/0.
+func TestRedisHandler(t *testing.T) {
+	url := os.Getenv("TASQUE_TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("TASQUE_TEST_REDIS_URL not set")
+	}
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(options)
+	defer client.Close()
+	stream := fmt.Sprintf("tasque-test-%d", time.Now().UnixNano())
+	deadLetterStream := stream + "-dead"
+	defer client.Del(stream, deadLetterStream)
+	newHandler := func(consumer string) *RedisHandler {
+		handler := &RedisHandler{
+			url:              url,
+			stream:           stream,
+			group:            "tasque",
+			consumer:         consumer,
+			claimIdle:        100 * time.Millisecond,
+			maxAttempts:      3,
+			deadLetterStream: deadLetterStream,
+		}
+		if err := handler.Initialize(); err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	first, second := newHandler("test-1"), newHandler("test-2")
+	defer first.client.Close()
+	defer second.client.Close()
+	pending := func() int64 {
+		summary, err := client.XPending(stream, "tasque").Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return summary.Count
+	}
+	receive := func(handler *RedisHandler, receiveCount int64) {
+		t.Helper()
+		if received, err := handler.Receive(); !received || err != nil {
+			t.Fatalf("%s: Receive() = %t, %v, want an entry", handler.consumer, received, err)
+		}
+		if handler.receiveCount != receiveCount {
+			t.Errorf("%s: receiveCount = %d, want %d", handler.consumer, handler.receiveCount, receiveCount)
+		}
+	}
+	failure := result.New()
+	failure.SetExit("1")
+	shutdown := result.New()
+	shutdown.SetExit("SHUTDOWN")
+
+	err = client.XAdd(&redis.XAddArgs{Stream: stream, Values: map[string]interface{}{redisPayloadField: `{"hello":"world"}`, "origin": "test"}}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(first, 1)
+	if *first.Body() != `{"hello":"world"}` || first.Attributes()["origin"] != "test" {
+		t.Errorf("Body, Attributes = %s, %v", *first.Body(), first.Attributes())
+	}
+	first.Failure(failure)
+	if pending() != 1 {
+		t.Fatalf("pending = %d after a failure, want 1", pending())
+	}
+
+	// Claimed once idle, which abandons it on the first consumer
+	time.Sleep(2 * first.claimIdle)
+	receive(second, 2)
+	first.Heartbeat()
+	select {
+	case <-first.Abandoned():
+	default:
+		t.Fatal("not abandoned after another consumer claimed the entry")
+	}
+	first.Success(nil)
+	if pending() != 1 {
+		t.Fatalf("pending = %d after an abandoned success, want the claimed entry", pending())
+	}
+
+	// The last attempt is released on shutdown, not dead lettered
+	second.Heartbeat()
+	if second.isAbandoned() {
+		t.Fatal("abandoned its own entry")
+	}
+	time.Sleep(2 * second.claimIdle)
+	receive(first, 3)
+	first.Failure(shutdown)
+	if length := client.XLen(deadLetterStream).Val(); length != 0 || pending() != 1 {
+		t.Fatalf("dead letters, pending = %d, %d after a shutdown, want 0, 1", length, pending())
+	}
+
+	time.Sleep(2 * first.claimIdle)
+	receive(second, 4)
+	second.Failure(failure)
+	deadLetters, err := client.XRange(deadLetterStream, "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters) != 1 || pending() != 0 {
+		t.Fatalf("dead letters, pending = %d, %d, want the entry moved", len(deadLetters), pending())
+	}
+	values := deadLetters[0].Values
+	if values[redisPayloadField] != `{"hello":"world"}` || values["TaskExit"] != "1" || values["TaskReceiveCount"] != "4" {
+		t.Errorf("dead letter = %v", values)
+	}
+
+	err = client.XAdd(&redis.XAddArgs{Stream: stream, Values: map[string]interface{}{"name": "second"}}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(first, 1)
+	if *first.Body() != `{"name":"second"}` {
+		t.Errorf("Body() = %s, want the fields as JSON", *first.Body())
+	}
+	first.Success(nil)
+	if pending() != 0 {
+		t.Errorf("pending = %d after a success, want 0", pending())
+	}
+}
@@ -7,6 +7,21 @@ import (
 	"os"
 )
 
+// Translations maps exit names to error names. When nil the EXIT_%s
+// environment variables are used instead.
+var Translations map[string]string
+
+// MessageTemplate is the template for Message. When empty the
+// ERROR_MESSAGE_TEMPLATE environment variable is used instead.
+var MessageTemplate string
+
+// Configure sets the exit translations and message template for every
+// Result.
+func Configure(translations map[string]string, messageTemplate string) {
+	Translations = translations
+	MessageTemplate = messageTemplate
+}
+
 type Result struct {
 	Exit  string
 	Error string
@@ -19,7 +34,12 @@ func New() Result {
 
 func (r *Result) SetExit(ex string) {
 	r.Exit = ex
-	err := os.Getenv(fmt.Sprintf("EXIT_%s", ex))
+	var err string
+	if Translations != nil {
+		err = Translations[ex]
+	} else {
+		err = os.Getenv(fmt.Sprintf("EXIT_%s", ex))
+	}
 	if err != "" {
 		r.Error = err
 	} else {
@@ -36,7 +56,10 @@ func (r *Result) Message() string {
 		r.host, _ = os.Hostname()
 	}
 
-	templ := os.Getenv("ERROR_MESSAGE_TEMPLATE")
+	templ := MessageTemplate
+	if templ == "" {
+		templ = os.Getenv("ERROR_MESSAGE_TEMPLATE")
+	}
 	if templ == "" {
 		templ = "Host: {{.Host}} Exit: {{.Exit}} Error: {{.Error}}"
 	}
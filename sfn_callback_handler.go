@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
+)
+
+func init() {
+	source.Register("sfn-callback", source.Registration{
+		New: builtin(func(config *Config) source.MessageHandler {
+			handler := &SFNCallbackHandler{
+				SQSHandler: newSQSHandler(config),
+				sfn:        newSFNHandler(config),
+				tokenPath:  config.Value("TASK_SFN_TOKEN_PATH"),
+			}
+			// Until the first message names one
+			handler.sfn.origin = "callbacks of " + handler.queueURL
+			return handler
+		}),
+		Settings: []source.Setting{
+			{Name: "TASK_SFN_TOKEN_PATH", Default: "$.TaskToken", Usage: "JSON path of the task token in SQS messages of a .waitForTaskToken integration"},
+		},
+		// Never detected, TASK_QUEUE_URL alone selects sqs
+		Required: []string{"TASK_QUEUE_URL"},
+	})
+}
+
+// SFNCallbackHandler receives the SQS messages of a Step Functions
+// .waitForTaskToken integration. The message is received, heartbeat and
+// retried on shutdown as by SQSHandler, the outcome is reported for the task
+// token in its body as by SFNHandler and the message deleted once Step
+// Functions has it.
+type SFNCallbackHandler struct {
+	*SQSHandler
+	sfn       *SFNHandler
+	tokenPath string
+}
+
+func (handler *SFNCallbackHandler) Initialize() error {
+	if err := handler.SQSHandler.Initialize(); err != nil {
+		return err
+	}
+	log.Printf("I: Reporting the task tokens at %s of %s", handler.tokenPath, handler.queueURL)
+	return handler.sfn.connect()
+}
+
+// Receive discards messages without a task token, they can't be reported.
+func (handler *SFNCallbackHandler) Receive() (bool, error) {
+	if received, err := handler.SQSHandler.Receive(); !received {
+		return false, err
+	}
+	token, err := jsonPathString(handler.messageBody, handler.tokenPath)
+	if err != nil {
+		log.Printf("E: Message %s has no task token %s", handler.messageID, err.Error())
+		r := result.New()
+		r.SetExit("TOKEN")
+		handler.discard(r)
+		return false, nil
+	}
+	handler.sfn.setToken(token, handler.messageBody)
+	handler.sfn.origin = "message " + handler.messageID + " of " + handler.queueURL
+	return true, nil
+}
+
+// discard moves a message that can never succeed to the dead letter queue,
+// or deletes it without one. Retrying it would only redeliver it forever.
+func (handler *SFNCallbackHandler) discard(err result.Result) {
+	if handler.deadLetterQueueURL == "" {
+		log.Printf("I: Deleting message %s, without TASK_DEAD_LETTER_QUEUE_URL", handler.messageID)
+		handler.SQSHandler.Success(nil)
+		return
+	}
+	if deadLetterError := handler.deadLetter(err); deadLetterError != nil {
+		log.Printf("E: Couldn't dead letter message %s %s", handler.messageID, deadLetterError.Error())
+		handler.SQSHandler.Failure(err)
+		return
+	}
+	handler.finishGroup()
+}
+
+// Success deletes the message once Step Functions took the output, and only
+// then replies with it. Until then the execution waits for the token, so a
+// failed report is retried. Output that isn't JSON is reported as a failure
+// and a task that is gone takes nothing, neither is replied.
+func (handler *SFNCallbackHandler) Success(output *string) {
+	err := handler.sfn.sendSuccess(output)
+	switch {
+	case err == nil:
+		handler.SQSHandler.Success(output)
+	case err == errInvalidOutput || sfnTaskGone(err):
+		handler.SQSHandler.Success(nil)
+	default:
+		r := result.New()
+		r.SetExit("CALLBACK")
+		handler.SQSHandler.Failure(r)
+	}
+}
+
+// Failure is reported to Step Functions, whose Retry and Catch decide what
+// happens next, and the message deleted. A shutdown leaves the message to
+// another worker instead, unless the task was abandoned.
+func (handler *SFNCallbackHandler) Failure(err result.Result) {
+	if err.Exit == "SHUTDOWN" && !handler.sfn.isAbandoned() {
+		handler.SQSHandler.Failure(err)
+		return
+	}
+	if sendError := handler.sfn.sendFailure(err); sendError != nil && !sfnTaskGone(sendError) {
+		handler.SQSHandler.Failure(err)
+		return
+	}
+	handler.SQSHandler.Success(nil)
+}
+
+// Heartbeat keeps the message invisible and the task alive.
+func (handler *SFNCallbackHandler) Heartbeat() {
+	handler.SQSHandler.Heartbeat()
+	handler.sfn.Heartbeat()
+}
+
+// Abandoned is closed once a heartbeat found the task timed out or gone.
+func (handler *SFNCallbackHandler) Abandoned() <-chan struct{} {
+	return handler.sfn.Abandoned()
+}
+
+// jsonPathString looks up a string by a path like $.TaskToken or
+// $.callback.tokens.0, numbers index arrays.
+func jsonPathString(body string, path string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(body), &value); err != nil {
+		return "", err
+	}
+	fields := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	for _, field := range strings.Split(fields, ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			value = node[field]
+		case []interface{}:
+			i, err := strconv.Atoi(field)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("%s: no element %s", path, field)
+			}
+			value = node[i]
+		default:
+			return "", fmt.Errorf("%s: %s is not in an object", path, field)
+		}
+	}
+	text, ok := value.(string)
+	if !ok || text == "" {
+		return "", fmt.Errorf("%s is not a string", path)
+	}
+	return text, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestJSONPathString(t *testing.T) {
+	tests := []struct {
+		body string
+		path string
+		want string
+		err  bool
+	}{
+		{`{"TaskToken":"abc"}`, "$.TaskToken", "abc", false},
+		{`{"callback":{"token":"abc"}}`, "$.callback.token", "abc", false},
+		{`{"callback":{"tokens":["abc","def"]}}`, "$.callback.tokens.1", "def", false},
+		{`["abc"]`, "$.0", "abc", false},
+		{`{"TaskToken":"abc"}`, "$.Token", "", true},
+		{`{"TaskToken":""}`, "$.TaskToken", "", true},
+		{`{"TaskToken":42}`, "$.TaskToken", "", true},
+		{`{"TaskToken":{"id":"abc"}}`, "$.TaskToken", "", true},
+		{`{"tokens":["abc"]}`, "$.tokens.1", "", true},
+		{`{"tokens":["abc"]}`, "$.tokens.first", "", true},
+		{`{"TaskToken":"abc"}`, "$.TaskToken.id", "", true},
+		{`TaskToken=abc`, "$.TaskToken", "", true},
+	}
+	for _, test := range tests {
+		got, err := jsonPathString(test.body, test.path)
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("jsonPathString(%s, %s) = %q, %v, want %q, error %t", test.body, test.path, got, err, test.want, test.err)
+		}
+	}
+}
+
+// newTestSFNCallbackHandler receives a message of body from a fake queue,
+// reported to a fake Step Functions
+func newTestSFNCallbackHandler(body string) (*SFNCallbackHandler, *fakeSQS, *fakeSFN) {
+	message := testSQSMessage("m1", "")
+	message.Body = aws.String(body)
+	queue := &fakeSQS{visibility: map[string]int64{}, messages: []*sqs.Message{message}}
+	stepFunctions := &fakeSFN{}
+	handler := &SFNCallbackHandler{
+		SQSHandler: &SQSHandler{
+			queueURL:        "https://sqs.us-west-2.amazonaws.com/123456789012/callbacks",
+			replyQueueURL:   "https://sqs.us-west-2.amazonaws.com/123456789012/replies",
+			retryBackoff:    30 * time.Second,
+			retryBackoffMax: time.Hour,
+		},
+		sfn:       &SFNHandler{},
+		tokenPath: "$.TaskToken",
+	}
+	handler.SQSHandler.newClient(queue)
+	handler.sfn.newClient(stepFunctions)
+	return handler, queue, stepFunctions
+}
+
+// sqsOutcome is what a handler did to the message m1 of a fakeSQS
+type sqsOutcome struct {
+	sent    int
+	deleted bool
+	// visibility is the last visibility change, -1 for none
+	visibility int64
+}
+
+func outcomeOf(queue *fakeSQS) sqsOutcome {
+	outcome := sqsOutcome{sent: len(queue.sent), deleted: len(queue.deleted) > 0, visibility: -1}
+	if visibility, ok := queue.visibility["m1"]; ok {
+		outcome.visibility = visibility
+	}
+	return outcome
+}
+
+func TestSFNCallbackReceiveDiscardsMessagesWithoutToken(t *testing.T) {
+	handler, queue, _ := newTestSFNCallbackHandler(`{"Input":{}}`)
+	if received, err := handler.Receive(); received || err != nil {
+		t.Fatalf("Receive() = %t, %v, want false, nil", received, err)
+	}
+	if got, want := outcomeOf(queue), (sqsOutcome{deleted: true, visibility: -1}); got != want {
+		t.Errorf("without a dead letter queue %+v, want %+v", got, want)
+	}
+
+	handler, queue, _ = newTestSFNCallbackHandler(`{"Input":{}}`)
+	handler.deadLetterQueueURL = "https://sqs.us-west-2.amazonaws.com/123456789012/callbacks-dead"
+	if received, err := handler.Receive(); received || err != nil {
+		t.Fatalf("Receive() = %t, %v, want false, nil", received, err)
+	}
+	if got, want := outcomeOf(queue), (sqsOutcome{sent: 1, deleted: true, visibility: -1}); got != want {
+		t.Fatalf("with a dead letter queue %+v, want %+v", got, want)
+	}
+	if exit := queue.sent[0].MessageAttributes["TaskExit"]; aws.StringValue(queue.sent[0].QueueUrl) != handler.deadLetterQueueURL || aws.StringValue(exit.StringValue) != "TOKEN" {
+		t.Errorf("sent to %s with exit %v, want the dead letter queue with TOKEN", aws.StringValue(queue.sent[0].QueueUrl), exit)
+	}
+}
+
+func TestSFNCallbackSuccess(t *testing.T) {
+	tests := []struct {
+		name       string
+		output     string
+		successErr error
+		successes  int
+		failures   int
+		want       sqsOutcome
+	}{
+		{"reported", `{"done":true}`, nil, 1, 0, sqsOutcome{sent: 1, deleted: true, visibility: -1}},
+		{"invalid output", "done", nil, 0, 1, sqsOutcome{deleted: true, visibility: -1}},
+		{"task gone", `{"done":true}`, awserr.New(sfn.ErrCodeTaskTimedOut, "Task Timed Out", nil), 1, 0, sqsOutcome{deleted: true, visibility: -1}},
+		// CALLBACK, received again after the backoff
+		{"not taken", `{"done":true}`, awserr.New("ServiceUnavailable", "unavailable", nil), 1, 0, sqsOutcome{visibility: 30}},
+	}
+	for _, test := range tests {
+		handler, queue, stepFunctions := newTestSFNCallbackHandler(`{"TaskToken":"token"}`)
+		stepFunctions.successErr = test.successErr
+		if received, err := handler.Receive(); !received || err != nil {
+			t.Fatalf("%s: Receive() = %t, %v, want the message", test.name, received, err)
+		}
+		handler.Success(aws.String(test.output))
+		if stepFunctions.successes != test.successes || stepFunctions.failures != test.failures {
+			t.Errorf("%s: reported %d successes, %d failures, want %d, %d", test.name, stepFunctions.successes, stepFunctions.failures, test.successes, test.failures)
+		}
+		if got := outcomeOf(queue); got != test.want {
+			t.Errorf("%s: %+v, want %+v", test.name, got, test.want)
+		}
+		if test.want.sent > 0 && aws.StringValue(queue.sent[0].MessageBody) != test.output {
+			t.Errorf("%s: replied %s, want the output", test.name, aws.StringValue(queue.sent[0].MessageBody))
+		}
+	}
+}
+
+func TestSFNCallbackFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		exit      string
+		abandoned bool
+		failures  int
+		want      sqsOutcome
+	}{
+		{"failed", "1", false, 1, sqsOutcome{deleted: true, visibility: -1}},
+		// Left to another worker, Step Functions still waits for the token
+		{"shutdown", "SHUTDOWN", false, 0, sqsOutcome{visibility: 0}},
+		// Step Functions gave up on the task, nothing to retry
+		{"shutdown of an abandoned task", "SHUTDOWN", true, 0, sqsOutcome{deleted: true, visibility: -1}},
+	}
+	for _, test := range tests {
+		handler, queue, stepFunctions := newTestSFNCallbackHandler(`{"TaskToken":"token"}`)
+		if received, err := handler.Receive(); !received || err != nil {
+			t.Fatalf("%s: Receive() = %t, %v, want the message", test.name, received, err)
+		}
+		if test.abandoned {
+			stepFunctions.heartbeatErr = awserr.New(sfn.ErrCodeTaskTimedOut, "Task Timed Out", nil)
+			handler.sfn.Heartbeat()
+		}
+		failure := result.New()
+		failure.SetExit(test.exit)
+		handler.Failure(failure)
+		if stepFunctions.failures != test.failures {
+			t.Errorf("%s: reported %d failures, want %d", test.name, stepFunctions.failures, test.failures)
+		}
+		if got := outcomeOf(queue); got != test.want {
+			t.Errorf("%s: %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
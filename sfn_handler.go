@@ -1,109 +1,249 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
+	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sfn"
-	"github.com/blaines/tasque-go/result"
+	"github.com/aws/aws-sdk-go/service/sfn/sfniface"
+)
+
+func init() {
+	source.Register("sfn", source.Registration{
+		New: builtin(func(config *Config) source.MessageHandler {
+			return newSFNHandler(config)
+		}),
+		Settings: []source.Setting{
+			{Name: "TASK_SFN_ENDPOINT", Usage: "Step Functions endpoint, e.g. Step Functions Local"},
+		},
+		Required: []string{"TASK_ACTIVITY_ARN"},
+		Detect: func(config source.Config) bool {
+			return config.Value("TASK_ACTIVITY_ARN") != ""
+		},
+	})
+}
+
+func newSFNHandler(config *Config) *SFNHandler {
+	handler := &SFNHandler{
+		activityARN: config.TaskActivityARN,
+		awsRegion:   config.AWSRegion,
+		endpoint:    config.Value("TASK_SFN_ENDPOINT"),
+	}
+	if handler.awsRegion == "" {
+		// arn:aws:states:region:account:activity:name
+		if parts := strings.Split(handler.activityARN, ":"); len(parts) > 3 {
+			handler.awsRegion = parts[3]
+		}
+	}
+	return handler
+}
+
+// Failed GetActivityTask calls are retried after sfnRetryBackoff, doubling
+// up to sfnRetryBackoffMax.
+const (
+	sfnRetryBackoff    = time.Second
+	sfnRetryBackoffMax = time.Minute
 )
 
 // SFNHandler hello world
 type SFNHandler struct {
-	client      sfn.SFN
+	client      sfniface.SFNAPI
 	messageBody string
 	taskToken   string
 	activityARN string
 	awsRegion   string
+	endpoint    string
+	// ctx is canceled when the worker shuts down, which ends a long poll
+	ctx context.Context
+	// origin tells where the current token came from in logs
+	origin string
+	// abandoned is closed once Step Functions rejected a heartbeat for the
+	// current task
+	abandoned chan struct{}
 }
 
 // SFNClient hello world
 type SFNClient struct {
 	activityARN string
 	awsRegion   string
-	sfnClient   sfn.SFN
+	sfnClient   sfniface.SFNAPI
 }
 
-func (handler *SFNHandler) id() *string {
+func (handler *SFNHandler) ID() *string {
 	// There's no real use for the full token
-	token := handler.taskToken[0:32]
+	token := handler.taskToken
+	if len(token) > 32 {
+		token = token[0:32]
+	}
 	return &token
 }
 
-func (handler *SFNHandler) body() *string {
+func (handler *SFNHandler) Body() *string {
 	return &handler.messageBody
 }
 
-func (handler *SFNHandler) initialize() {
+// Attributes is nil, an activity task is only its input.
+func (handler *SFNHandler) Attributes() map[string]string {
+	return nil
+}
+
+// SetContext makes Receive return once the worker shuts down.
+func (handler *SFNHandler) SetContext(ctx context.Context) {
+	handler.ctx = ctx
+}
+
+func (handler *SFNHandler) Initialize() error {
 	log.Printf("Configuring handler. activityARN:%s", handler.activityARN)
-	sess, err := session.NewSession(&aws.Config{Region: aws.String(strings.Split(handler.activityARN, ":")[3])})
+	return handler.connect()
+}
+
+// connect creates the Step Functions client.
+func (handler *SFNHandler) connect() error {
+	config := &aws.Config{
+		Region: aws.String(handler.awsRegion),
+		// Receive retries GetActivityTask with its own backoff, a few
+		// quick retries are left to the SDK for the other calls
+		MaxRetries: aws.Int(3),
+		HTTPClient: &http.Client{
+			// GetActivityTask holds the connection for up to 60 seconds
+			Timeout: 90 * time.Second,
+		},
+	}
+	if handler.endpoint != "" {
+		config.Endpoint = aws.String(handler.endpoint)
+	}
+	sess, err := session.NewSession(config)
 	if err != nil {
-		fmt.Println("failed to create session,", err)
-		panic("failed to create session")
+		return err
 	}
-
-	// client := sfn.New(sess, &aws.Config{
-	// 	MaxRetries: aws.Int(30),
-	// 	HTTPClient: &http.Client{
-	// 		Timeout: 30 * time.Second,
-	// 	},
-	// })
-	client := sfn.New(sess)
-	handler.newClient(*client)
+	handler.newClient(sfn.New(sess))
+	return nil
 }
 
-func (handler *SFNHandler) newClient(client sfn.SFN) {
+func (handler *SFNHandler) newClient(client sfniface.SFNAPI) {
 	handler.client = client
+	if handler.ctx == nil {
+		handler.ctx = context.Background()
+	}
 }
 
-func (handler *SFNHandler) receive() bool {
+// Receive long polls until a task arrives. Throttling and network errors
+// are retried with backoff, other errors are returned and a shutdown returns
+// false.
+func (handler *SFNHandler) Receive() (bool, error) {
+	failures := 0
 	for {
 		log.Printf("Waiting for SFN activity data from %s", handler.activityARN)
 		hostname, _ := os.Hostname()
+		handler.origin = "activity " + handler.activityARN + " worker " + hostname
 		getActivityTaskParams := &sfn.GetActivityTaskInput{
 			ActivityArn: aws.String(handler.activityARN),
 			WorkerName:  aws.String(hostname),
 		}
-		receiveMessageResponse, receiveMessageError := handler.client.GetActivityTask(getActivityTaskParams)
+		receiveMessageResponse, receiveMessageError := handler.client.GetActivityTaskWithContext(handler.ctx, getActivityTaskParams)
 
+		if handler.ctx.Err() != nil {
+			if receiveMessageError == nil && receiveMessageResponse.TaskToken != nil {
+				// Got a task anyway, the worker hands it back
+				handler.setTask(receiveMessageResponse)
+				return true, nil
+			}
+			return false, nil
+		}
 		if receiveMessageError != nil {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Fatal("E: ", receiveMessageError.Error())
-			return false
+			if !request.IsErrorThrottle(receiveMessageError) && !request.IsErrorRetryable(receiveMessageError) {
+				return false, receiveMessageError
+			}
+			failures++
+			backoff := source.RetryBackoff(sfnRetryBackoff, sfnRetryBackoffMax, failures)
+			log.Printf("E: %s, retrying in %s", receiveMessageError.Error(), backoff)
+			if !source.Sleep(handler.ctx, backoff) {
+				return false, nil
+			}
+			continue
 		}
+		failures = 0
 
 		if receiveMessageResponse.TaskToken != nil {
-			handler.messageBody = *receiveMessageResponse.Input
-			handler.taskToken = *receiveMessageResponse.TaskToken
-
-			writeFileError := ioutil.WriteFile("payload.json", []byte(handler.messageBody), 0644)
-			if writeFileError != nil {
-				panic(writeFileError)
-			}
-			return true
+			handler.setTask(receiveMessageResponse)
+			return true, nil
 		}
 	}
 }
 
-func (handler *SFNHandler) success() {
+func (handler *SFNHandler) setTask(task *sfn.GetActivityTaskOutput) {
+	handler.setToken(*task.TaskToken, aws.StringValue(task.Input))
+}
+
+// setToken starts reporting for the task of token, input is passed through
+// when the task has no output.
+func (handler *SFNHandler) setToken(token string, input string) {
+	handler.messageBody = input
+	handler.taskToken = token
+	handler.abandoned = make(chan struct{})
+}
+
+func (handler *SFNHandler) Success(output *string) {
+	handler.sendSuccess(output)
+}
+
+// errInvalidOutput is returned by sendSuccess when it reported a failure
+// instead, because the output wasn't JSON.
+var errInvalidOutput = errors.New("task output is not valid JSON")
+
+// sendSuccess reports the output, an error when Step Functions didn't take
+// the result. A task that timed out or is gone is abandoned.
+func (handler *SFNHandler) sendSuccess(output *string) error {
+	if output == nil {
+		// Nothing captured, pass the input through as before
+		output = aws.String(handler.messageBody)
+	}
+	if !json.Valid([]byte(*output)) {
+		log.Printf("E: Task output is not valid JSON: %s", *output)
+		err := result.New()
+		err.SetExit("OUTPUT")
+		if sendError := handler.sendFailure(err); sendError != nil {
+			return sendError
+		}
+		return errInvalidOutput
+	}
 	sendTaskSuccessParams := &sfn.SendTaskSuccessInput{
-		Output:    aws.String(handler.messageBody),
+		Output:    output,
 		TaskToken: aws.String(handler.taskToken),
 	}
 	_, deleteMessageError := handler.client.SendTaskSuccess(sendTaskSuccessParams)
 
 	if deleteMessageError != nil {
-		return
+		handler.logTaskError("SendTaskSuccess", deleteMessageError)
+		handler.abandonIfGone(deleteMessageError)
+		return deleteMessageError
 	}
+	return nil
+}
+
+// Failure isn't reported for an abandoned task, Step Functions already
+// failed it and rejects the token.
+func (handler *SFNHandler) Failure(err result.Result) {
+	handler.sendFailure(err)
 }
 
-func (handler *SFNHandler) failure(err result.Result) {
+func (handler *SFNHandler) sendFailure(err result.Result) error {
+	if handler.isAbandoned() {
+		log.Printf("I: Not reporting %s of abandoned task %s", err.Exit, *handler.ID())
+		return nil
+	}
 	sendTaskFailureParams := &sfn.SendTaskFailureInput{
 		TaskToken: aws.String(handler.taskToken),
 		Error:     aws.String(err.Error),
@@ -112,18 +252,64 @@ func (handler *SFNHandler) failure(err result.Result) {
 	_, deleteMessageError := handler.client.SendTaskFailure(sendTaskFailureParams)
 
 	if deleteMessageError != nil {
-		log.Printf("Couldn't send task failure %+v", deleteMessageError)
-		return
+		handler.logTaskError("SendTaskFailure", deleteMessageError)
+		handler.abandonIfGone(deleteMessageError)
+		return deleteMessageError
 	}
+	return nil
 }
 
-func (handler *SFNHandler) heartbeat() {
+// Heartbeat abandons the task once Step Functions reports it timed out or
+// gone, its task is stopped rather than left running for nothing.
+func (handler *SFNHandler) Heartbeat() {
 	sendTaskHeartbeatParams := &sfn.SendTaskHeartbeatInput{
 		TaskToken: aws.String(handler.taskToken),
 	}
 	_, deleteMessageError := handler.client.SendTaskHeartbeat(sendTaskHeartbeatParams)
 
 	if deleteMessageError != nil {
+		handler.logTaskError("SendTaskHeartbeat", deleteMessageError)
+		handler.abandonIfGone(deleteMessageError)
 		return
 	}
 }
+
+// abandonIfGone abandons the task when err says it timed out or is gone.
+func (handler *SFNHandler) abandonIfGone(err error) {
+	if sfnTaskGone(err) && !handler.isAbandoned() {
+		close(handler.abandoned)
+	}
+}
+
+// Abandoned is closed once a heartbeat found the current task timed out or
+// gone.
+func (handler *SFNHandler) Abandoned() <-chan struct{} {
+	return handler.abandoned
+}
+
+func (handler *SFNHandler) isAbandoned() bool {
+	select {
+	case <-handler.abandoned:
+		return true
+	default:
+		return false
+	}
+}
+
+// logTaskError logs with the full token, the truncated ID isn't enough to
+// find a timed out task in the execution history.
+func (handler *SFNHandler) logTaskError(call string, err error) {
+	log.Printf("E: %s failed for %s token %s %s", call, handler.origin, handler.taskToken, err.Error())
+}
+
+// sfnTaskGone tells whether Step Functions no longer accepts anything for a
+// task, because it timed out or its execution ended.
+func sfnTaskGone(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case sfn.ErrCodeTaskTimedOut, sfn.ErrCodeTaskDoesNotExist:
+			return true
+		}
+	}
+	return false
+}
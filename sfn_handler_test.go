@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sfn/sfniface"
+)
+
+func TestSFNTaskGone(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{awserr.New(sfn.ErrCodeTaskTimedOut, "Task Timed Out", nil), true},
+		{awserr.New(sfn.ErrCodeTaskDoesNotExist, "Task does not exist", nil), true},
+		{awserr.New(sfn.ErrCodeInvalidToken, "Invalid token", nil), false},
+		{awserr.New(request.ErrCodeResponseTimeout, "timeout", nil), false},
+		{errors.New("TaskTimedOut"), false},
+	}
+	for _, test := range tests {
+		if got := sfnTaskGone(test.err); got != test.want {
+			t.Errorf("sfnTaskGone(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+// fakeSFN answers GetActivityTask with err, heartbeats with heartbeatErr
+// and success reports with successErr, failure reports always succeed
+type fakeSFN struct {
+	sfniface.SFNAPI
+	err          error
+	heartbeatErr error
+	successErr   error
+	successes    int
+	failures     int
+}
+
+func (client *fakeSFN) GetActivityTaskWithContext(ctx aws.Context, input *sfn.GetActivityTaskInput, options ...request.Option) (*sfn.GetActivityTaskOutput, error) {
+	return &sfn.GetActivityTaskOutput{}, client.err
+}
+
+func (client *fakeSFN) SendTaskHeartbeat(input *sfn.SendTaskHeartbeatInput) (*sfn.SendTaskHeartbeatOutput, error) {
+	return &sfn.SendTaskHeartbeatOutput{}, client.heartbeatErr
+}
+
+func (client *fakeSFN) SendTaskSuccess(input *sfn.SendTaskSuccessInput) (*sfn.SendTaskSuccessOutput, error) {
+	client.successes++
+	return &sfn.SendTaskSuccessOutput{}, client.successErr
+}
+
+func (client *fakeSFN) SendTaskFailure(input *sfn.SendTaskFailureInput) (*sfn.SendTaskFailureOutput, error) {
+	client.failures++
+	return &sfn.SendTaskFailureOutput{}, nil
+}
+
+func TestSFNReceiveReturnsNonRetryableErrors(t *testing.T) {
+	receiveErr := awserr.New(sfn.ErrCodeActivityDoesNotExist, "Activity does not exist", nil)
+	handler := &SFNHandler{activityARN: "arn:aws:states:us-west-2:123456789012:activity:missing"}
+	handler.newClient(&fakeSFN{err: receiveErr})
+	if received, err := handler.Receive(); received || err != receiveErr {
+		t.Errorf("Receive() = %t, %v, want false, %v", received, err, receiveErr)
+	}
+}
+
+func TestSFNReceiveStopsBackingOffOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := &SFNHandler{activityARN: "arn:aws:states:us-west-2:123456789012:activity:busy"}
+	handler.SetContext(ctx)
+	handler.newClient(&fakeSFN{err: awserr.New("ThrottlingException", "Rate exceeded", nil)})
+	time.AfterFunc(10*time.Millisecond, cancel)
+	started := time.Now()
+	if received, err := handler.Receive(); received || err != nil {
+		t.Errorf("Receive() = %t, %v, want false, nil on shutdown", received, err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Receive() returned %s after the shutdown", elapsed)
+	}
+}
+
+func TestSFNHeartbeatAbandonsGoneTasks(t *testing.T) {
+	client := &fakeSFN{heartbeatErr: awserr.New("ServiceUnavailable", "unavailable", nil)}
+	handler := &SFNHandler{}
+	handler.newClient(client)
+	handler.setToken("token", "{}")
+	handler.Heartbeat()
+	if handler.isAbandoned() {
+		t.Fatal("abandoned after a heartbeat that may succeed next time")
+	}
+	client.heartbeatErr = awserr.New(sfn.ErrCodeTaskTimedOut, "Task Timed Out", nil)
+	handler.Heartbeat()
+	handler.Heartbeat()
+	select {
+	case <-handler.Abandoned():
+	default:
+		t.Error("not abandoned after Step Functions timed the task out")
+	}
+}
+
+func TestSFNSendSuccessAbandonsGoneTasks(t *testing.T) {
+	client := &fakeSFN{}
+	handler := &SFNHandler{}
+	handler.newClient(client)
+	handler.setToken("token", "{}")
+	if err := handler.sendSuccess(aws.String(`{"done":true}`)); err != nil || handler.isAbandoned() {
+		t.Fatalf("sendSuccess() = %v, abandoned %t, want the success reported", err, handler.isAbandoned())
+	}
+	client.successErr = awserr.New(sfn.ErrCodeTaskDoesNotExist, "Task does not exist", nil)
+	if err := handler.sendSuccess(aws.String(`{"done":true}`)); err == nil || !handler.isAbandoned() {
+		t.Errorf("sendSuccess() = %v, abandoned %t, want the gone task abandoned", err, handler.isAbandoned())
+	}
+}
+
+func TestSFNSendSuccessFailsInvalidOutput(t *testing.T) {
+	client := &fakeSFN{}
+	handler := &SFNHandler{}
+	handler.newClient(client)
+	handler.setToken("token", "{}")
+	if err := handler.sendSuccess(aws.String("done")); err != errInvalidOutput {
+		t.Errorf("sendSuccess() = %v, want %v", err, errInvalidOutput)
+	}
+	if client.successes != 0 || client.failures != 1 {
+		t.Errorf("successes, failures = %d, %d, want the output reported as a failure", client.successes, client.failures)
+	}
+}
+
+// TestSFNHandler runs an activity task of a one state machine on the Step
+// Functions Local at TASQUE_TEST_SFN_ENDPOINT, e.g. http://localhost:8083.
+func TestSFNHandler(t *testing.T) {
+	endpoint := os.Getenv("TASQUE_TEST_SFN_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("TASQUE_TEST_SFN_ENDPOINT not set")
+	}
+	// Step Functions Local takes any credentials
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		t.Setenv("AWS_ACCESS_KEY_ID", "tasque")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "tasque")
+	}
+	handler := &SFNHandler{awsRegion: "us-east-1", endpoint: endpoint}
+	if err := handler.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("tasque-test-%d", time.Now().UnixNano())
+	activity, err := handler.client.CreateActivity(&sfn.CreateActivityInput{Name: aws.String(name)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.client.DeleteActivity(&sfn.DeleteActivityInput{ActivityArn: activity.ActivityArn})
+	handler.activityARN = *activity.ActivityArn
+	machine, err := handler.client.CreateStateMachine(&sfn.CreateStateMachineInput{
+		Name:       aws.String(name),
+		RoleArn:    aws.String("arn:aws:iam::123456789012:role/tasque-test"),
+		Definition: aws.String(fmt.Sprintf(`{"StartAt":"Run","States":{"Run":{"Type":"Task","Resource":%q,"End":true}}}`, *activity.ActivityArn)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.client.DeleteStateMachine(&sfn.DeleteStateMachineInput{StateMachineArn: machine.StateMachineArn})
+	execution, err := handler.client.StartExecution(&sfn.StartExecutionInput{
+		StateMachineArn: machine.StateMachineArn,
+		Input:           aws.String(`{"hello":"world"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if received, err := handler.Receive(); !received || err != nil {
+		t.Fatalf("Receive() = %t, %v, want the execution's task", received, err)
+	}
+	if *handler.Body() != `{"hello":"world"}` {
+		t.Errorf("Body() = %s, want the execution input", *handler.Body())
+	}
+	handler.Heartbeat()
+	handler.Success(aws.String(`{"done":true}`))
+
+	var status, output string
+	for deadline := time.Now().Add(10 * time.Second); status != sfn.ExecutionStatusSucceeded && time.Now().Before(deadline); {
+		described, err := handler.client.DescribeExecution(&sfn.DescribeExecutionInput{ExecutionArn: execution.ExecutionArn})
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, output = aws.StringValue(described.Status), aws.StringValue(described.Output)
+		time.Sleep(100 * time.Millisecond)
+	}
+	if status != sfn.ExecutionStatusSucceeded || output != `{"done":true}` {
+		t.Errorf("execution %s with output %s, want SUCCEEDED with the task output", status, output)
+	}
+}
@@ -0,0 +1,115 @@
+package source
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config is how a source reads its settings. A setting that can't be used
+// is reported with Invalid instead of failing right away, so that every
+// problem is listed at once.
+type Config interface {
+	// Value returns a setting or its default, "" when neither is set
+	Value(name string) string
+	Int(name string) int
+	Duration(name string) time.Duration
+	Bool(name string) bool
+	Invalid(name string, reason string)
+}
+
+// Setting describes one configuration value. Name is the environment
+// variable, config file key and, in lower case with dashes, the flag.
+type Setting struct {
+	Name    string
+	Default string
+	Usage   string
+	// Secret values are redacted by `tasque config print`
+	Secret bool
+}
+
+// Factory builds the MessageHandler of one worker. It must not connect
+// anywhere, that is what MessageHandler.Initialize is for.
+type Factory func(config Config) MessageHandler
+
+// Registration describes a message source that can be selected with
+// TASK_SOURCE.
+type Registration struct {
+	New Factory
+	// Settings are the configuration values only this source reads
+	Settings []Setting
+	// Required settings must be set when this source is selected
+	Required []string
+	// Detect selects this source when TASK_SOURCE is unset
+	Detect func(config Config) bool
+	// Daemon sources keep receiving without TASK_CONCURRENCY
+	Daemon bool
+}
+
+var registry = map[string]Registration{}
+
+// settings are those of every registered source, in registration order
+var settings []Setting
+
+// detectOrder keeps the original TASK_PAYLOAD, TASK_QUEUE_URL,
+// TASK_ACTIVITY_ARN priority ahead of any other source.
+var detectOrder = []string{"env", "sqs", "sfn"}
+
+// Register makes a message source available as TASK_SOURCE=name. Call it
+// from the init function of the file implementing the MessageHandler.
+func Register(name string, registration Registration) {
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("message source %s registered twice", name))
+	}
+	registry[name] = registration
+	settings = append(settings, registration.Settings...)
+}
+
+// Settings are the settings of every registered source.
+func Settings() []Setting {
+	return append([]Setting{}, settings...)
+}
+
+// Select picks the source named by TASK_SOURCE, or the first one whose
+// settings are present.
+func Select(config Config) (string, Registration, error) {
+	if name := strings.ToLower(config.Value("TASK_SOURCE")); name != "" {
+		registration, ok := registry[name]
+		if !ok {
+			return "", registration, fmt.Errorf("TASK_SOURCE: unknown source %q, expected one of %s", name, strings.Join(Names(), ", "))
+		}
+		return name, registration, nil
+	}
+	for _, name := range sourceDetectOrder() {
+		registration := registry[name]
+		if registration.Detect != nil && registration.Detect(config) {
+			return name, registration, nil
+		}
+	}
+	return "", Registration{}, fmt.Errorf("TASK_SOURCE: no message source configured, expected one of %s", strings.Join(Names(), ", "))
+}
+
+// Names lists the registered sources.
+func Names() []string {
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sourceDetectOrder() []string {
+	order := append([]string{}, detectOrder...)
+	for _, name := range Names() {
+		builtin := false
+		for _, b := range detectOrder {
+			builtin = builtin || b == name
+		}
+		if !builtin {
+			order = append(order, name)
+		}
+	}
+	return order
+}
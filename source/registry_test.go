@@ -0,0 +1,92 @@
+package source
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+)
+
+// testConfig serves settings from a map
+type testConfig map[string]string
+
+func (c testConfig) Value(name string) string           { return c[name] }
+func (c testConfig) Int(name string) int                { return 0 }
+func (c testConfig) Duration(name string) time.Duration { return 0 }
+func (c testConfig) Bool(name string) bool              { return c[name] == "true" }
+func (c testConfig) Invalid(name string, reason string) {}
+
+type testHandler struct{}
+
+func (handler *testHandler) ID() *string                   { return new(string) }
+func (handler *testHandler) Body() *string                 { return new(string) }
+func (handler *testHandler) Attributes() map[string]string { return nil }
+func (handler *testHandler) Initialize() error             { return nil }
+func (handler *testHandler) Receive() (bool, error)        { return false, nil }
+func (handler *testHandler) Success(output *string)        {}
+func (handler *testHandler) Failure(err result.Result)     {}
+func (handler *testHandler) Heartbeat()                    {}
+
+func detectSetting(name string) func(config Config) bool {
+	return func(config Config) bool {
+		return config.Value(name) != ""
+	}
+}
+
+func init() {
+	newTestHandler := func(config Config) MessageHandler { return &testHandler{} }
+	// Registered out of order, detection still prefers sqs
+	Register("test-carrier", Registration{
+		New:      newTestHandler,
+		Settings: []Setting{{Name: "TEST_CARRIER_URL"}},
+		Detect:   detectSetting("TEST_CARRIER_URL"),
+	})
+	Register("sqs", Registration{
+		New:    newTestHandler,
+		Detect: detectSetting("TASK_QUEUE_URL"),
+	})
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		config testConfig
+		want   string
+		err    string
+	}{
+		{testConfig{"TASK_SOURCE": "Test-Carrier"}, "test-carrier", ""},
+		{testConfig{"TEST_CARRIER_URL": "carrier://"}, "test-carrier", ""},
+		{testConfig{"TEST_CARRIER_URL": "carrier://", "TASK_QUEUE_URL": "https://sqs"}, "sqs", ""},
+		{testConfig{"TASK_SOURCE": "sqs", "TEST_CARRIER_URL": "carrier://"}, "sqs", ""},
+		{testConfig{"TASK_SOURCE": "pigeon"}, "", `TASK_SOURCE: unknown source "pigeon", expected one of sqs, test-carrier`},
+		{testConfig{}, "", "TASK_SOURCE: no message source configured"},
+	}
+	for _, test := range tests {
+		name, _, err := Select(test.config)
+		if name != test.want {
+			t.Errorf("Select(%v) = %q, want %q", test.config, name, test.want)
+		}
+		if (err == nil) != (test.err == "") || (err != nil && !strings.HasPrefix(err.Error(), test.err)) {
+			t.Errorf("Select(%v) error = %v, want %q", test.config, err, test.err)
+		}
+	}
+}
+
+func TestSettingsOfRegisteredSources(t *testing.T) {
+	found := false
+	for _, setting := range Settings() {
+		found = found || setting.Name == "TEST_CARRIER_URL"
+	}
+	if !found {
+		t.Errorf("Settings() = %v, want TEST_CARRIER_URL", Settings())
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering sqs again didn't panic")
+		}
+	}()
+	Register("sqs", Registration{})
+}
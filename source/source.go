@@ -0,0 +1,195 @@
+// Package source defines how tasque receives messages: the MessageHandler a
+// message source implements, the optional interfaces a worker looks for and
+// the registry TASK_SOURCE selects a source from.
+package source
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/Skycatch/tasque-go/result"
+)
+
+// MessageHandler receives messages from a source and reports their outcome
+// back to it. Every worker has its own handler, so implementations only
+// hold one message at a time. Register new sources with Register.
+type MessageHandler interface {
+	// ID identifies the current message in logs and to the task
+	ID() *string
+	// Body is the current message's payload
+	Body() *string
+	// Attributes is the current message's metadata, passed to the task as
+	// TASK_ATTR_* variables. nil when the source has none.
+	Attributes() map[string]string
+	// Initialize connects to the source, once per worker. An error stops
+	// tasque.
+	Initialize() error
+	// Receive waits for the next message, false when there was none. An
+	// error means the source couldn't be read, the worker backs off before
+	// receiving again.
+	Receive() (bool, error)
+	// Success acknowledges the message. output is what the task produced,
+	// nil when nothing was captured.
+	Success(output *string)
+	// Failure reports why the task failed
+	Failure(err result.Result)
+	// Heartbeat is called periodically while the task runs
+	Heartbeat()
+}
+
+// FiniteHandler is implemented by sources that can run out of messages for
+// good. Daemon workers stop once Receive found nothing and Exhausted is true.
+type FiniteHandler interface {
+	Exhausted() bool
+}
+
+// EnvironmentHandler is implemented by sources with more to tell the task
+// than its ID, payload and attributes, such as TASK_RECEIVE_COUNT.
+// Environment is read for every message and added to the task's environment.
+type EnvironmentHandler interface {
+	Environment() map[string]string
+}
+
+// TaskEnvironment is what the task gets in its environment for the current
+// message besides TASK_PAYLOAD, as sorted NAME=value pairs. Empty values are
+// left out.
+func TaskEnvironment(handler MessageHandler) []string {
+	variables := map[string]string{}
+	for name, value := range handler.Attributes() {
+		variables["TASK_ATTR_"+AttributeEnvName(name)] = value
+	}
+	if environment, ok := handler.(EnvironmentHandler); ok {
+		for name, value := range environment.Environment() {
+			variables[name] = value
+		}
+	}
+	var pairs []string
+	for name, value := range variables {
+		if value != "" {
+			pairs = append(pairs, name+"="+value)
+		}
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// AttributeEnvName turns an attribute name like SentTimestamp, AWSTraceHeader
+// or site-id into SENT_TIMESTAMP, AWS_TRACE_HEADER or SITE_ID.
+func AttributeEnvName(name string) string {
+	runes := []rune(name)
+	var env []rune
+	var previous rune
+	for i, r := range runes {
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		switch {
+		case unicode.IsUpper(r) && (unicode.IsLower(previous) || unicode.IsDigit(previous) ||
+			(unicode.IsUpper(previous) && unicode.IsLower(next))):
+			env = append(env, '_', r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			env = append(env, unicode.ToUpper(r))
+		default:
+			r = '_'
+			if previous != '_' {
+				env = append(env, r)
+			}
+		}
+		previous = r
+	}
+	return string(env)
+}
+
+// ContextHandler is implemented by sources whose Receive blocks longer than
+// a shutdown should wait. SetContext is called before Initialize with the
+// worker's context, which is canceled on shutdown.
+type ContextHandler interface {
+	SetContext(ctx context.Context)
+}
+
+// AbandonableHandler is implemented by sources that can give up on a
+// message while its task is running, such as a Step Functions task that
+// timed out. The task is stopped as on shutdown once the channel returned
+// for the current message is closed.
+type AbandonableHandler interface {
+	Abandoned() <-chan struct{}
+}
+
+// ClosableHandler is implemented by sources that hold more than the current
+// message. Close is called once its worker stopped receiving.
+type ClosableHandler interface {
+	Close()
+}
+
+// TaskResult is the JSON form of a result.Result, for sources that report it
+// back as a document.
+type TaskResult struct {
+	Exit    string `json:"exit"`
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// NewTaskResult describes err as a TaskResult.
+func NewTaskResult(err result.Result) *TaskResult {
+	return &TaskResult{
+		Exit:    err.Exit,
+		Error:   err.Error,
+		Message: err.Message(),
+	}
+}
+
+// Sleep waits for d, false when ctx was canceled first.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Poll calls try every interval until it found a message or failed, for at
+// most wait. It returns early with nothing found once ctx was canceled.
+func Poll(ctx context.Context, interval time.Duration, wait time.Duration, try func() (bool, error)) (bool, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		found, err := try()
+		if err != nil || found {
+			return found, err
+		}
+		if time.Now().Add(interval).After(deadline) || !Sleep(ctx, interval) {
+			return false, nil
+		}
+	}
+}
+
+// RetryBackoff doubles backoff for every receive after the first, up to max.
+func RetryBackoff(backoff time.Duration, max time.Duration, receiveCount int) time.Duration {
+	for i := 1; i < receiveCount && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// consumers numbers the handlers of this process for ConsumerName
+var consumers int64
+
+// ConsumerName identifies one worker's handler to a source that tracks who
+// holds a message, prefix defaults to the hostname.
+func ConsumerName(prefix string) string {
+	if prefix == "" {
+		prefix, _ = os.Hostname()
+	}
+	return fmt.Sprintf("%s-%d-%d", prefix, os.Getpid(), atomic.AddInt64(&consumers, 1))
+}
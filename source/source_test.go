@@ -0,0 +1,135 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		receiveCount int
+		want         time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{6, 15 * time.Minute},
+		{100, 15 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := RetryBackoff(30*time.Second, 15*time.Minute, test.receiveCount); got != test.want {
+			t.Errorf("RetryBackoff(30s, 15m, %d) = %s, want %s", test.receiveCount, got, test.want)
+		}
+	}
+}
+
+func TestRetryBackoffCapsInitialBackoff(t *testing.T) {
+	if got := RetryBackoff(time.Hour, time.Minute, 1); got != time.Minute {
+		t.Errorf("RetryBackoff(1h, 1m, 1) = %s, want 1m", got)
+	}
+}
+
+func TestPollStopsAtFirstMessage(t *testing.T) {
+	tries := 0
+	found, err := Poll(context.Background(), time.Millisecond, time.Minute, func() (bool, error) {
+		tries++
+		return tries == 3, nil
+	})
+	if !found || err != nil || tries != 3 {
+		t.Errorf("Poll() = %t, %v after %d tries, want true, nil after 3", found, err, tries)
+	}
+}
+
+func TestPollReturnsErrors(t *testing.T) {
+	tryErr := errors.New("connection refused")
+	found, err := Poll(context.Background(), time.Millisecond, time.Minute, func() (bool, error) {
+		return false, tryErr
+	})
+	if found || err != tryErr {
+		t.Errorf("Poll() = %t, %v, want false, %v", found, err, tryErr)
+	}
+}
+
+func TestPollGivesUpAfterWait(t *testing.T) {
+	tries := 0
+	found, err := Poll(context.Background(), time.Minute, 0, func() (bool, error) {
+		tries++
+		return false, nil
+	})
+	if found || err != nil || tries != 1 {
+		t.Errorf("Poll() = %t, %v after %d tries, want false, nil after 1", found, err, tries)
+	}
+}
+
+func TestPollStopsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	started := time.Now()
+	found, err := Poll(ctx, time.Minute, time.Hour, func() (bool, error) {
+		return false, nil
+	})
+	if found || err != nil || time.Since(started) > 5*time.Second {
+		t.Errorf("Poll() = %t, %v after %s, want false, nil right after the shutdown", found, err, time.Since(started))
+	}
+}
+
+func TestAttributeEnvName(t *testing.T) {
+	tests := map[string]string{
+		"SentTimestamp":                    "SENT_TIMESTAMP",
+		"ApproximateReceiveCount":          "APPROXIMATE_RECEIVE_COUNT",
+		"AWSTraceHeader":                   "AWS_TRACE_HEADER",
+		"MessageGroupId":                   "MESSAGE_GROUP_ID",
+		"site-id":                          "SITE_ID",
+		"x.request..id":                    "X_REQUEST_ID",
+		"Retry3Times":                      "RETRY3_TIMES",
+		"already_SNAKE":                    "ALREADY_SNAKE",
+		"TASK":                             "TASK",
+		"SenderId":                         "SENDER_ID",
+		"ApproximateFirstReceiveTimestamp": "APPROXIMATE_FIRST_RECEIVE_TIMESTAMP",
+	}
+	for name, want := range tests {
+		if got := AttributeEnvName(name); got != want {
+			t.Errorf("AttributeEnvName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// attributeHandler has attributes and an environment of its own
+type attributeHandler struct {
+	testHandler
+	attributes  map[string]string
+	environment map[string]string
+}
+
+func (handler *attributeHandler) Attributes() map[string]string  { return handler.attributes }
+func (handler *attributeHandler) Environment() map[string]string { return handler.environment }
+
+func TestTaskEnvironment(t *testing.T) {
+	handler := &attributeHandler{
+		attributes: map[string]string{
+			"SentTimestamp": "1526919030474",
+			"site-id":       "42",
+			"Empty":         "",
+		},
+		environment: map[string]string{
+			"TASK_RECEIVE_COUNT":    "2",
+			"TASK_MESSAGE_GROUP_ID": "",
+		},
+	}
+	want := []string{
+		"TASK_ATTR_SENT_TIMESTAMP=1526919030474",
+		"TASK_ATTR_SITE_ID=42",
+		"TASK_RECEIVE_COUNT=2",
+	}
+	if got := TaskEnvironment(handler); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("TaskEnvironment() = %v, want %v", got, want)
+	}
+	if got := TaskEnvironment(&testHandler{}); len(got) != 0 {
+		t.Errorf("TaskEnvironment() without attributes = %v, want none", got)
+	}
+}
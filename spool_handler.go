@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
+)
+
+func init() {
+	source.Register("spool", source.Registration{
+		New: builtin(func(config *Config) source.MessageHandler {
+			handler := &SpoolHandler{
+				dir:          config.Value("TASK_SPOOL_DIR"),
+				watch:        strings.ToLower(config.Value("TASK_SPOOL_WATCH")) != "false",
+				pollInterval: config.positiveDuration("TASK_SPOOL_POLL_INTERVAL"),
+				claimIdle:    config.Duration("TASK_SPOOL_CLAIM_IDLE"),
+			}
+			if handler.claimIdle == 0 {
+				// Heartbeats touch the file, survive one missed heartbeat
+				handler.claimIdle = 2 * config.Heartbeat
+			}
+			return handler
+		}),
+		Settings: []source.Setting{
+			{Name: "TASK_SPOOL_DIR", Usage: "Directory of *.json task files to run"},
+			{Name: "TASK_SPOOL_WATCH", Default: "true", Usage: "Keep watching TASK_SPOOL_DIR, false exits once it is empty"},
+			{Name: "TASK_SPOOL_POLL_INTERVAL", Default: "1s", Usage: "How often an idle worker looks for new files"},
+			{Name: "TASK_SPOOL_CLAIM_IDLE", Usage: "Time since its last heartbeat after which a file in processing/ is run again, twice TASK_HEARTBEAT when unset"},
+		},
+		Required: []string{"TASK_SPOOL_DIR"},
+		Detect: func(config source.Config) bool {
+			return config.Value("TASK_SPOOL_DIR") != ""
+		},
+		Daemon: true,
+	})
+}
+
+// Subdirectories of the spool a task file moves through
+const (
+	spoolProcessing = "processing"
+	spoolDone       = "done"
+	spoolFailed     = "failed"
+)
+
+// spoolResult is written next to a finished task file as name.result.json.
+type spoolResult struct {
+	Status   string             `json:"status"`
+	Output   *string            `json:"output,omitempty"`
+	Result   *source.TaskResult `json:"result,omitempty"`
+	Finished time.Time          `json:"finished"`
+}
+
+// SpoolHandler runs the *.json files of a directory. A file is claimed by
+// renaming it into processing/, which only one worker or tasque process can
+// win, and is moved to done/ or failed/ with a .result.json sidecar once it
+// finished. Writers should create files under another name and rename them
+// to *.json when complete. Heartbeats touch the file in processing/, files
+// of a worker that died are moved back once untouched for claimIdle.
+type SpoolHandler struct {
+	messageID    string
+	messageBody  string
+	dir          string
+	watch        bool
+	pollInterval time.Duration
+	claimIdle    time.Duration
+	empty        bool
+	// touched is the modification time this worker last gave its file, any
+	// other means the file was reclaimed.
+	touched time.Time
+	// abandoned is closed once a heartbeat found the current file reclaimed
+	abandoned chan struct{}
+	// ctx is canceled when the worker shuts down, which ends polling
+	ctx context.Context
+}
+
+func (handler *SpoolHandler) ID() *string {
+	return &handler.messageID
+}
+
+func (handler *SpoolHandler) Body() *string {
+	return &handler.messageBody
+}
+
+// Attributes is nil, a task file is only its payload.
+func (handler *SpoolHandler) Attributes() map[string]string {
+	return nil
+}
+
+// SetContext makes Receive return once the worker shuts down.
+func (handler *SpoolHandler) SetContext(ctx context.Context) {
+	handler.ctx = ctx
+}
+
+func (handler *SpoolHandler) Initialize() error {
+	if handler.ctx == nil {
+		handler.ctx = context.Background()
+	}
+	for _, sub := range []string{spoolProcessing, spoolDone, spoolFailed} {
+		if err := os.MkdirAll(filepath.Join(handler.dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (handler *SpoolHandler) Receive() (bool, error) {
+	wait := 20 * time.Second
+	if !handler.watch {
+		// One look is enough to tell the spool is empty
+		wait = 0
+	}
+	found, err := source.Poll(handler.ctx, handler.pollInterval, wait, handler.claim)
+	if err != nil {
+		return false, err
+	}
+	handler.empty = !found
+	if !found && handler.ctx.Err() == nil {
+		log.Println("I: ", "No messages retrieved from spool")
+	}
+	return found, nil
+}
+
+// Exhausted stops the workers once the spool is empty, unless it is watched.
+func (handler *SpoolHandler) Exhausted() bool {
+	return !handler.watch && handler.empty
+}
+
+// claim moves the first task file into processing/. Files another worker
+// renamed first are skipped.
+func (handler *SpoolHandler) claim() (bool, error) {
+	handler.reclaim()
+	names, err := filepath.Glob(filepath.Join(handler.dir, "*.json"))
+	if err != nil {
+		return false, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		base := filepath.Base(name)
+		processing := filepath.Join(handler.dir, spoolProcessing, base)
+		if err := os.Rename(name, processing); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return false, err
+		}
+		handler.messageID = base
+		// The file keeps its modification time through the rename
+		if err := handler.touch(); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return false, err
+		}
+		body, err := ioutil.ReadFile(processing)
+		if err != nil {
+			return false, err
+		}
+		handler.messageBody = string(body)
+		handler.abandoned = make(chan struct{})
+		return true, nil
+	}
+	return false, nil
+}
+
+// reclaim moves the files of processing/ that weren't touched for claimIdle
+// back into the spool, their worker died or was killed.
+func (handler *SpoolHandler) reclaim() {
+	names, err := filepath.Glob(filepath.Join(handler.dir, spoolProcessing, "*.json"))
+	if err != nil {
+		log.Println("E: ", err.Error())
+		return
+	}
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		idle := time.Since(info.ModTime())
+		if idle < handler.claimIdle {
+			continue
+		}
+		if err := os.Rename(name, filepath.Join(handler.dir, filepath.Base(name))); err == nil {
+			log.Printf("I: Reclaimed message %s, idle for %s", filepath.Base(name), idle)
+		}
+	}
+}
+
+// touch sets the file's modification time to now and remembers it.
+func (handler *SpoolHandler) touch() error {
+	now := time.Now()
+	if err := os.Chtimes(handler.processingPath(), now, now); err != nil {
+		return err
+	}
+	info, err := os.Stat(handler.processingPath())
+	if err != nil {
+		return err
+	}
+	handler.touched = info.ModTime()
+	return nil
+}
+
+// Success moves the file to done/, unless it was abandoned.
+func (handler *SpoolHandler) Success(output *string) {
+	if handler.isAbandoned() {
+		log.Printf("I: Not finishing message %s, it was reclaimed", handler.messageID)
+		return
+	}
+	handler.finish(spoolDone, spoolResult{Status: "succeeded", Output: output})
+}
+
+// Failure moves the file to failed/, unless it was abandoned.
+func (handler *SpoolHandler) Failure(err result.Result) {
+	if handler.isAbandoned() {
+		log.Printf("I: Not failing message %s, it was reclaimed", handler.messageID)
+		return
+	}
+	if err.Exit == "SHUTDOWN" {
+		// Not the task's fault, leave it for the next run
+		handler.move(handler.dir)
+		return
+	}
+	handler.finish(spoolFailed, spoolResult{Status: "failed", Result: source.NewTaskResult(err)})
+}
+
+// Heartbeat touches the file in processing/, so its modification time tells
+// whether the task is still running. A file that is gone or was touched by
+// another worker was reclaimed after a missed heartbeat and is abandoned.
+func (handler *SpoolHandler) Heartbeat() {
+	if handler.isAbandoned() {
+		return
+	}
+	info, err := os.Stat(handler.processingPath())
+	if os.IsNotExist(err) || (err == nil && !info.ModTime().Equal(handler.touched)) {
+		log.Printf("E: Message %s was reclaimed, abandoning it", handler.messageID)
+		close(handler.abandoned)
+		return
+	}
+	if err == nil {
+		err = handler.touch()
+	}
+	if err != nil {
+		log.Printf("E: Couldn't heartbeat message %s %s", handler.messageID, err.Error())
+	}
+}
+
+// Abandoned is closed once a heartbeat found the current file reclaimed.
+func (handler *SpoolHandler) Abandoned() <-chan struct{} {
+	return handler.abandoned
+}
+
+func (handler *SpoolHandler) isAbandoned() bool {
+	select {
+	case <-handler.abandoned:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish writes the sidecar first, a file in done/ or failed/ always has
+// its result.
+func (handler *SpoolHandler) finish(sub string, outcome spoolResult) {
+	outcome.Finished = time.Now().UTC()
+	body, err := json.MarshalIndent(outcome, "", "  ")
+	if err == nil {
+		sidecar := strings.TrimSuffix(handler.messageID, ".json") + ".result.json"
+		err = ioutil.WriteFile(filepath.Join(handler.dir, sub, sidecar), body, 0644)
+	}
+	if err != nil {
+		log.Printf("E: Couldn't write result of message %s %s", handler.messageID, err.Error())
+	}
+	handler.move(filepath.Join(handler.dir, sub))
+}
+
+func (handler *SpoolHandler) move(dir string) {
+	if err := os.Rename(handler.processingPath(), filepath.Join(dir, handler.messageID)); err != nil {
+		log.Printf("E: Couldn't move message %s %s", handler.messageID, err.Error())
+	}
+}
+
+func (handler *SpoolHandler) processingPath() string {
+	return filepath.Join(handler.dir, spoolProcessing, handler.messageID)
+}
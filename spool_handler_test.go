@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+)
+
+func TestSpoolHandler(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.json", "b.json", "c.tmp"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(`{"file":"`+name+`"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := &SpoolHandler{dir: dir, pollInterval: time.Second, claimIdle: time.Minute}
+	if err := handler.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if received, err := handler.Receive(); !received || err != nil || *handler.ID() != "a.json" {
+		t.Fatalf("Receive() = %t, %v with %s, want a.json", received, err, *handler.ID())
+	}
+	output := `{"done":true}`
+	handler.Success(&output)
+
+	if received, err := handler.Receive(); !received || err != nil || *handler.ID() != "b.json" {
+		t.Fatalf("Receive() = %t, %v with %s, want b.json", received, err, *handler.ID())
+	}
+	shutdown := result.New()
+	shutdown.SetExit("SHUTDOWN")
+	handler.Failure(shutdown)
+	if _, err := os.Stat(filepath.Join(dir, "b.json")); err != nil {
+		t.Errorf("b.json not back in the spool after a shutdown: %v", err)
+	}
+
+	if received, err := handler.Receive(); !received || err != nil || *handler.ID() != "b.json" {
+		t.Fatalf("Receive() = %t, %v with %s, want b.json again", received, err, *handler.ID())
+	}
+	failure := result.New()
+	failure.SetExit("1")
+	handler.Failure(failure)
+
+	if received, err := handler.Receive(); received || err != nil || !handler.Exhausted() {
+		t.Fatalf("Receive() = %t, %v, Exhausted() = %t, want an exhausted spool", received, err, handler.Exhausted())
+	}
+
+	var done spoolResult
+	body, err := ioutil.ReadFile(filepath.Join(dir, spoolDone, "a.result.json"))
+	if err == nil {
+		err = json.Unmarshal(body, &done)
+	}
+	if err != nil || done.Status != "succeeded" || done.Output == nil || *done.Output != output {
+		t.Errorf("a.result.json = %s, %v", body, err)
+	}
+	var failed spoolResult
+	body, err = ioutil.ReadFile(filepath.Join(dir, spoolFailed, "b.result.json"))
+	if err == nil {
+		err = json.Unmarshal(body, &failed)
+	}
+	if err != nil || failed.Status != "failed" || failed.Result == nil || failed.Result.Exit != "1" {
+		t.Errorf("b.result.json = %s, %v", body, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spoolFailed, "b.json")); err != nil {
+		t.Errorf("b.json not in failed/: %v", err)
+	}
+}
+
+func TestSpoolHandlerStopsPollingOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := &SpoolHandler{dir: t.TempDir(), watch: true, pollInterval: time.Minute}
+	handler.SetContext(ctx)
+	if err := handler.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	started := time.Now()
+	if received, err := handler.Receive(); received || err != nil {
+		t.Fatalf("Receive() = %t, %v, want false, nil", received, err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Receive() returned %s after the shutdown", elapsed)
+	}
+}
+
+func TestSpoolHandlerReclaimsStaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := &SpoolHandler{dir: dir, pollInterval: time.Second, claimIdle: time.Minute}
+	if err := first.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	// Left behind by a worker that died an hour ago, and one still running
+	hourAgo := time.Now().Add(-time.Hour)
+	for _, name := range []string{"crashed.json", "running.json"} {
+		path := filepath.Join(dir, spoolProcessing, name)
+		if err := ioutil.WriteFile(path, []byte(`{"file":"`+name+`"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(dir, spoolProcessing, "crashed.json"), hourAgo, hourAgo); err != nil {
+		t.Fatal(err)
+	}
+	if received, err := first.Receive(); !received || err != nil || *first.ID() != "crashed.json" {
+		t.Fatalf("Receive() = %t, %v with %s, want crashed.json", received, err, *first.ID())
+	}
+	if _, err := os.Stat(filepath.Join(dir, spoolProcessing, "running.json")); err != nil {
+		t.Errorf("running.json reclaimed: %v", err)
+	}
+
+	// The first worker missed its heartbeats, the second reclaims its file
+	if err := os.Chtimes(first.processingPath(), hourAgo, hourAgo); err != nil {
+		t.Fatal(err)
+	}
+	second := &SpoolHandler{dir: dir, pollInterval: time.Second, claimIdle: time.Minute}
+	if err := second.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if received, err := second.Receive(); !received || err != nil || *second.ID() != "crashed.json" {
+		t.Fatalf("Receive() = %t, %v with %s, want crashed.json again", received, err, *second.ID())
+	}
+	second.Heartbeat()
+	first.Heartbeat()
+	if !first.isAbandoned() || second.isAbandoned() {
+		t.Fatalf("abandoned %t, %t, want only the first worker's file", first.isAbandoned(), second.isAbandoned())
+	}
+	first.Success(nil)
+	if _, err := os.Stat(second.processingPath()); err != nil {
+		t.Fatalf("the abandoned success moved the reclaimed file: %v", err)
+	}
+	second.Success(nil)
+	if _, err := os.Stat(filepath.Join(dir, spoolDone, "crashed.json")); err != nil {
+		t.Errorf("crashed.json not in done/: %v", err)
+	}
+}
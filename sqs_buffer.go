@@ -0,0 +1,309 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// sqsMaxBatch is the most messages SQS receives, deletes or changes in one
+// call.
+const sqsMaxBatch = 10
+
+// sqsDeleteInterval is how long a succeeded message may wait for its batch
+// to fill before it is deleted anyway.
+const sqsDeleteInterval = time.Second
+
+// sqsReceipt is a received message as the batch calls need it.
+type sqsReceipt struct {
+	messageID     string
+	receiptHandle string
+}
+
+// sqsBuffer holds the messages of batch receives that no worker has started
+// yet, shared by all workers. Buffered messages are kept invisible every
+// heartbeat until a worker takes them and are released on shutdown.
+// Succeeded messages are deleted in batches. Of a FIFO message group only
+// one message runs at a time.
+type sqsBuffer struct {
+	client            sqsiface.SQSAPI
+	queueURL          string
+	size              int
+	visibilityTimeout time.Duration
+	heartbeat         time.Duration
+	starting          sync.Once
+	mu                sync.Mutex
+	messages          []*sqs.Message
+	// reserved is the room held for receives in flight, so the buffer
+	// never grows beyond size.
+	reserved int
+	// groups are the FIFO message groups a worker is running a message of
+	groups  map[string]bool
+	deletes []sqsReceipt
+	workers int
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+var (
+	sqsBufferOnce sync.Once
+	sqsBufferInst *sqsBuffer
+)
+
+// sharedSQSBuffer creates the buffer the first time a worker's handler is
+// built. It starts extending visibility on the first attach.
+func sharedSQSBuffer(queueURL string, size int, visibilityTimeout time.Duration, heartbeat time.Duration) *sqsBuffer {
+	sqsBufferOnce.Do(func() {
+		sqsBufferInst = &sqsBuffer{
+			queueURL:          queueURL,
+			size:              size,
+			visibilityTimeout: visibilityTimeout,
+			heartbeat:         heartbeat,
+			groups:            map[string]bool{},
+			stop:              make(chan struct{}),
+			stopped:           make(chan struct{}),
+		}
+	})
+	return sqsBufferInst
+}
+
+// attach registers a worker, the buffer is released once all of them
+// detached.
+func (buffer *sqsBuffer) attach(client sqsiface.SQSAPI) {
+	buffer.mu.Lock()
+	buffer.workers++
+	buffer.mu.Unlock()
+	buffer.starting.Do(func() {
+		buffer.client = client
+		go buffer.loop()
+	})
+}
+
+func (buffer *sqsBuffer) detach() {
+	buffer.mu.Lock()
+	buffer.workers--
+	last := buffer.workers == 0
+	buffer.mu.Unlock()
+	if !last {
+		return
+	}
+	close(buffer.stop)
+	<-buffer.stopped
+	buffer.release()
+	buffer.flush()
+}
+
+func (buffer *sqsBuffer) loop() {
+	defer close(buffer.stopped)
+	extend := time.NewTicker(buffer.heartbeat)
+	defer extend.Stop()
+	deletes := time.NewTicker(sqsDeleteInterval)
+	defer deletes.Stop()
+	for {
+		select {
+		case <-extend.C:
+			buffer.extend()
+		case <-deletes.C:
+			buffer.flush()
+		case <-buffer.stop:
+			return
+		}
+	}
+}
+
+// pop hands the oldest buffered message to a worker whose group isn't
+// running, nil when there is none.
+func (buffer *sqsBuffer) pop() *sqs.Message {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	for i, message := range buffer.messages {
+		group := sqsMessageGroup(message)
+		if group != "" && buffer.groups[group] {
+			continue
+		}
+		buffer.messages = append(buffer.messages[:i:i], buffer.messages[i+1:]...)
+		buffer.start(group)
+		return message
+	}
+	return nil
+}
+
+// start marks a group running, mu is held.
+func (buffer *sqsBuffer) start(group string) {
+	if group != "" {
+		buffer.groups[group] = true
+	}
+}
+
+func (buffer *sqsBuffer) finishGroup(group string) {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	delete(buffer.groups, group)
+}
+
+// releaseGroup makes the buffered messages of a failed message's group
+// available again, SQS delivers them after the failed one.
+func (buffer *sqsBuffer) releaseGroup(group string) {
+	buffer.mu.Lock()
+	var receipts []sqsReceipt
+	kept := buffer.messages[:0:0]
+	for _, message := range buffer.messages {
+		if sqsMessageGroup(message) == group {
+			receipts = append(receipts, newSQSReceipt(message))
+		} else {
+			kept = append(kept, message)
+		}
+	}
+	buffer.messages = kept
+	buffer.mu.Unlock()
+	buffer.changeVisibility(receipts, 0)
+}
+
+func sqsMessageGroup(message *sqs.Message) string {
+	return aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+}
+
+func newSQSReceipt(message *sqs.Message) sqsReceipt {
+	return sqsReceipt{
+		messageID:     aws.StringValue(message.MessageId),
+		receiptHandle: aws.StringValue(message.ReceiptHandle),
+	}
+}
+
+// reserve returns how many messages a receive may ask for, the one the
+// worker runs and what fits into the buffer. push must follow with the
+// extra messages.
+func (buffer *sqsBuffer) reserve() int {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	room := buffer.size - len(buffer.messages) - buffer.reserved
+	if room > sqsMaxBatch-1 {
+		room = sqsMaxBatch - 1
+	}
+	if room < 0 {
+		room = 0
+	}
+	buffer.reserved += room
+	return room + 1
+}
+
+// push buffers the messages a worker received beyond the one it runs and
+// gives back the room reserve held for them.
+func (buffer *sqsBuffer) push(running *sqs.Message, messages []*sqs.Message, reserved int) {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	buffer.reserved -= reserved
+	if running != nil {
+		buffer.start(sqsMessageGroup(running))
+	}
+	buffer.messages = append(buffer.messages, messages...)
+}
+
+// delete queues a succeeded message for the next DeleteMessageBatch, right
+// away once a batch is full.
+func (buffer *sqsBuffer) delete(receipt sqsReceipt) {
+	buffer.mu.Lock()
+	buffer.deletes = append(buffer.deletes, receipt)
+	full := len(buffer.deletes) >= sqsMaxBatch
+	buffer.mu.Unlock()
+	if full {
+		buffer.flush()
+	}
+}
+
+func (buffer *sqsBuffer) flush() {
+	buffer.mu.Lock()
+	receipts := buffer.deletes
+	buffer.deletes = nil
+	buffer.mu.Unlock()
+	for len(receipts) > 0 {
+		batch := receipts
+		if len(batch) > sqsMaxBatch {
+			batch = batch[:sqsMaxBatch]
+		}
+		receipts = receipts[len(batch):]
+		entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(batch))
+		for i, receipt := range batch {
+			entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: aws.String(receipt.receiptHandle),
+			}
+		}
+		response, err := buffer.client.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(buffer.queueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			log.Printf("E: Couldn't delete %d messages %s", len(batch), err.Error())
+			continue
+		}
+		for _, failed := range response.Failed {
+			i, _ := strconv.Atoi(aws.StringValue(failed.Id))
+			log.Printf("E: Couldn't delete message %s %s", batch[i].messageID, aws.StringValue(failed.Message))
+		}
+	}
+}
+
+// extend keeps the buffered messages invisible for another
+// visibilityTimeout.
+func (buffer *sqsBuffer) extend() {
+	buffer.changeVisibility(buffer.buffered(false), buffer.visibilityTimeout)
+}
+
+// release makes the buffered messages available to other consumers again.
+func (buffer *sqsBuffer) release() {
+	receipts := buffer.buffered(true)
+	if len(receipts) > 0 {
+		log.Printf("I: Releasing %d buffered messages", len(receipts))
+	}
+	buffer.changeVisibility(receipts, 0)
+}
+
+// buffered lists the buffered messages, clear empties the buffer.
+func (buffer *sqsBuffer) buffered(clear bool) []sqsReceipt {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	receipts := make([]sqsReceipt, len(buffer.messages))
+	for i, message := range buffer.messages {
+		receipts[i] = newSQSReceipt(message)
+	}
+	if clear {
+		buffer.messages = nil
+	}
+	return receipts
+}
+
+func (buffer *sqsBuffer) changeVisibility(receipts []sqsReceipt, visibility time.Duration) {
+	for len(receipts) > 0 {
+		batch := receipts
+		if len(batch) > sqsMaxBatch {
+			batch = batch[:sqsMaxBatch]
+		}
+		receipts = receipts[len(batch):]
+		entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, len(batch))
+		for i, receipt := range batch {
+			entries[i] = &sqs.ChangeMessageVisibilityBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(i)),
+				ReceiptHandle:     aws.String(receipt.receiptHandle),
+				VisibilityTimeout: aws.Int64(int64(visibility.Seconds())),
+			}
+		}
+		response, err := buffer.client.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+			QueueUrl: aws.String(buffer.queueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			log.Printf("E: Couldn't change visibility of %d messages %s", len(batch), err.Error())
+			continue
+		}
+		for _, failed := range response.Failed {
+			i, _ := strconv.Atoi(aws.StringValue(failed.Id))
+			log.Printf("E: Couldn't change visibility of message %s %s", batch[i].messageID, aws.StringValue(failed.Message))
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// fakeSQS hands out messages and records the calls of an SQSHandler and
+// the batch calls of an sqsBuffer
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	mu          sync.Mutex
+	deleted     [][]string
+	visibility  map[string]int64
+	changeCalls int
+	messages    []*sqs.Message
+	sent        []*sqs.SendMessageInput
+	sendErr     error
+}
+
+func (client *fakeSQS) DeleteMessageBatch(input *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	var handles []string
+	for _, entry := range input.Entries {
+		handles = append(handles, aws.StringValue(entry.ReceiptHandle))
+	}
+	client.deleted = append(client.deleted, handles)
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+func (client *fakeSQS) ChangeMessageVisibilityBatch(input *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.changeCalls++
+	for _, entry := range input.Entries {
+		client.visibility[aws.StringValue(entry.ReceiptHandle)] = aws.Int64Value(entry.VisibilityTimeout)
+	}
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+func newTestSQSBuffer(size int) (*sqsBuffer, *fakeSQS) {
+	client := &fakeSQS{visibility: map[string]int64{}}
+	buffer := &sqsBuffer{
+		client:            client,
+		queueURL:          "https://sqs.us-west-2.amazonaws.com/123456789012/tasks.fifo",
+		size:              size,
+		visibilityTimeout: time.Minute,
+		heartbeat:         time.Hour,
+		groups:            map[string]bool{},
+		stop:              make(chan struct{}),
+		stopped:           make(chan struct{}),
+	}
+	return buffer, client
+}
+
+// testSQSMessage is a message whose ID is also its receipt handle
+func testSQSMessage(id string, group string) *sqs.Message {
+	message := &sqs.Message{MessageId: aws.String(id), ReceiptHandle: aws.String(id)}
+	if group != "" {
+		message.Attributes = map[string]*string{sqs.MessageSystemAttributeNameMessageGroupId: aws.String(group)}
+	}
+	return message
+}
+
+func TestSQSBufferReserve(t *testing.T) {
+	buffer, _ := newTestSQSBuffer(15)
+	// The running message plus at most a batch's worth of buffered ones
+	if got := buffer.reserve(); got != sqsMaxBatch {
+		t.Errorf("first reserve() = %d, want %d", got, sqsMaxBatch)
+	}
+	if got := buffer.reserve(); got != 7 {
+		t.Errorf("second reserve() = %d, want 7, the room the first didn't hold", got)
+	}
+	if got := buffer.reserve(); got != 1 {
+		t.Errorf("reserve() of a full buffer = %d, want 1", got)
+	}
+	var extra []*sqs.Message
+	for _, id := range []string{"1", "2", "3"} {
+		extra = append(extra, testSQSMessage(id, ""))
+	}
+	// The first receive got fewer messages than it reserved room for
+	buffer.push(testSQSMessage("0", ""), extra, sqsMaxBatch-1)
+	if buffer.reserved != 6 || len(buffer.messages) != 3 {
+		t.Errorf("reserved, buffered = %d, %d after push, want 6, 3", buffer.reserved, len(buffer.messages))
+	}
+	if got := buffer.reserve(); got != 7 {
+		t.Errorf("reserve() after push = %d, want 7", got)
+	}
+}
+
+func TestSQSBufferPopsInOrder(t *testing.T) {
+	buffer, _ := newTestSQSBuffer(10)
+	buffer.push(nil, []*sqs.Message{testSQSMessage("1", ""), testSQSMessage("2", "")}, 0)
+	for _, want := range []string{"1", "2"} {
+		if message := buffer.pop(); message == nil || *message.MessageId != want {
+			t.Fatalf("pop() = %v, want %s", message, want)
+		}
+	}
+	if message := buffer.pop(); message != nil {
+		t.Errorf("pop() of an empty buffer = %s", *message.MessageId)
+	}
+}
+
+func TestSQSBufferRunsOneMessagePerGroup(t *testing.T) {
+	buffer, _ := newTestSQSBuffer(10)
+	buffer.push(testSQSMessage("a1", "a"), []*sqs.Message{
+		testSQSMessage("a2", "a"),
+		testSQSMessage("b1", "b"),
+		testSQSMessage("a3", "a"),
+		testSQSMessage("n1", ""),
+	}, 0)
+	pop := func() string {
+		if message := buffer.pop(); message != nil {
+			return *message.MessageId
+		}
+		return ""
+	}
+	// a1 is running, so its group waits while b1 and ungrouped n1 run
+	for _, want := range []string{"b1", "n1", ""} {
+		if got := pop(); got != want {
+			t.Fatalf("pop() = %q, want %q", got, want)
+		}
+	}
+	buffer.finishGroup("a")
+	if got := pop(); got != "a2" {
+		t.Fatalf("pop() after a1 finished = %q, want a2", got)
+	}
+	buffer.finishGroup("b")
+	if got := pop(); got != "" {
+		t.Errorf("pop() while a2 runs = %q, want nothing", got)
+	}
+	buffer.finishGroup("a")
+	if got := pop(); got != "a3" {
+		t.Errorf("pop() after a2 finished = %q, want a3", got)
+	}
+}
+
+func TestSQSBufferReleasesGroupOfFailedMessage(t *testing.T) {
+	buffer, client := newTestSQSBuffer(10)
+	buffer.push(testSQSMessage("a1", "a"), []*sqs.Message{
+		testSQSMessage("a2", "a"),
+		testSQSMessage("b1", "b"),
+	}, 0)
+	buffer.releaseGroup("a")
+	if visibility, ok := client.visibility["a2"]; !ok || visibility != 0 {
+		t.Errorf("visibility of a2 = %d, %t, want it made visible", visibility, ok)
+	}
+	if _, ok := client.visibility["b1"]; ok {
+		t.Error("b1 of another group was released")
+	}
+	buffer.finishGroup("a")
+	if message := buffer.pop(); message == nil || *message.MessageId != "b1" {
+		t.Errorf("pop() = %v, want b1 as the only buffered message", message)
+	}
+}
+
+func TestSQSBufferDeletesInBatches(t *testing.T) {
+	buffer, client := newTestSQSBuffer(10)
+	for i := 0; i < sqsMaxBatch+2; i++ {
+		id := string(rune('a' + i))
+		buffer.delete(sqsReceipt{messageID: id, receiptHandle: id})
+	}
+	if len(client.deleted) != 1 || len(client.deleted[0]) != sqsMaxBatch {
+		t.Fatalf("deleted = %v, want one full batch", client.deleted)
+	}
+	buffer.flush()
+	if len(client.deleted) != 2 || len(client.deleted[1]) != 2 {
+		t.Errorf("deleted = %v, want the remaining 2 flushed", client.deleted)
+	}
+}
+
+func TestSQSBufferReleasesOnLastDetach(t *testing.T) {
+	buffer, client := newTestSQSBuffer(10)
+	buffer.attach(client)
+	buffer.attach(client)
+	buffer.push(nil, []*sqs.Message{testSQSMessage("1", "")}, 0)
+	buffer.delete(sqsReceipt{messageID: "0", receiptHandle: "0"})
+
+	buffer.detach()
+	if client.changeCalls != 0 || len(client.deleted) != 0 {
+		t.Fatalf("released or flushed while a worker is attached")
+	}
+	buffer.detach()
+	if visibility, ok := client.visibility["1"]; !ok || visibility != 0 {
+		t.Errorf("visibility of buffered message = %d, %t, want it released", visibility, ok)
+	}
+	if len(client.deleted) != 1 || client.deleted[0][0] != "0" {
+		t.Errorf("deleted = %v, want the pending delete flushed", client.deleted)
+	}
+}
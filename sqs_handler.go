@@ -1,28 +1,110 @@
 package main
 
 import (
-	"io/ioutil"
+	"encoding/base64"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
-	"github.com/blaines/tasque-go/result"
 )
 
+func init() {
+	source.Register("sqs", source.Registration{
+		New: builtin(func(config *Config) source.MessageHandler {
+			return newSQSHandler(config)
+		}),
+		Settings: []source.Setting{
+			{Name: "TASK_SQS_PREFETCH", Default: "0", Usage: "Messages received ahead of the workers and buffered, up to 10 are received at once"},
+			{Name: "TASK_SQS_S3_BUCKET", Usage: "Bucket reply and dead letter messages over 256KB are stored in"},
+			{Name: "TASK_SQS_S3_ENDPOINT", Usage: "S3 endpoint for payloads, e.g. a local S3 compatible server"},
+			{Name: "TASK_SQS_S3_DELETE", Default: "false", Usage: "Delete a message's S3 payload once it succeeded"},
+		},
+		Required: []string{"TASK_QUEUE_URL"},
+		Detect: func(config source.Config) bool {
+			return config.Value("TASK_QUEUE_URL") != ""
+		},
+	})
+}
+
+func newSQSHandler(config *Config) *SQSHandler {
+	handler := &SQSHandler{
+		queueURL:           config.TaskQueueURL,
+		visibilityTimeout:  config.VisibilityTimeout,
+		awsRegion:          config.AWSRegion,
+		retryBackoff:       config.RetryBackoff,
+		retryBackoffMax:    config.RetryBackoffMax,
+		maxAttempts:        config.MaxAttempts,
+		deadLetterQueueURL: config.DeadLetterQueueURL,
+		replyQueueURL:      config.ReplyQueueURL,
+		fifo:               strings.HasSuffix(config.TaskQueueURL, ".fifo"),
+		s3Bucket:           config.Value("TASK_SQS_S3_BUCKET"),
+		s3Endpoint:         config.Value("TASK_SQS_S3_ENDPOINT"),
+		s3Delete:           strings.ToLower(config.Value("TASK_SQS_S3_DELETE")) == "true",
+	}
+	if prefetch := config.Int("TASK_SQS_PREFETCH"); prefetch > 0 {
+		handler.buffer = sharedSQSBuffer(config.TaskQueueURL, prefetch, config.VisibilityTimeout, config.Heartbeat)
+	}
+	return handler
+}
+
 // SQSHandler hello world
 type SQSHandler struct {
 	client        sqsiface.SQSAPI
 	messageID     string
 	messageBody   string
 	receiptHandle string
+	receiveCount  int
+	attributes    map[string]string
 	queueURL      string
-	awsRegion     string
+	// FIFO queues deliver a message group's messages in order, the group
+	// is passed to the task and to FIFO reply and dead letter queues.
+	fifo            bool
+	groupID         string
+	sequenceNumber  string
+	deduplicationID string
+	// receiveAttemptID is kept for the retry of a failed FIFO receive, so
+	// SQS returns the messages the failed attempt may already have taken.
+	receiveAttemptID string
+	awsRegion        string
+	// Every heartbeat keeps the message invisible for visibilityTimeout
+	// longer.
+	visibilityTimeout time.Duration
+	// Failed messages become visible again after retryBackoff, doubling
+	// with every receive up to retryBackoffMax.
+	retryBackoff    time.Duration
+	retryBackoffMax time.Duration
+	// After maxAttempts receives a failed message is moved to
+	// deadLetterQueueURL instead of being retried.
+	maxAttempts        int
+	deadLetterQueueURL string
+	// Task output is published to replyQueueURL when set.
+	replyQueueURL string
+	// buffer holds messages received ahead when TASK_SQS_PREFETCH is set,
+	// succeeded messages are deleted through it in batches.
+	buffer *sqsBuffer
+	// Payloads over the SQS size limit live in S3, the body only points to
+	// them. payload is the current message's, rawBody its pointer body.
+	s3         s3iface.S3API
+	s3Bucket   string
+	s3Endpoint string
+	s3Delete   bool
+	payload    *s3Pointer
+	rawBody    string
 }
 
+// maxVisibilityTimeout is the longest visibility timeout SQS accepts.
+const maxVisibilityTimeout = 12 * time.Hour
+
 // SQSClient hello world
 type SQSClient struct {
 	queueURL  string
@@ -30,59 +112,195 @@ type SQSClient struct {
 	sqsClient sqsiface.SQSAPI
 }
 
-func (handler *SQSHandler) id() *string {
+func (handler *SQSHandler) ID() *string {
 	return &handler.messageID
 }
 
-func (handler *SQSHandler) body() *string {
+func (handler *SQSHandler) Body() *string {
 	return &handler.messageBody
 }
 
-func (handler *SQSHandler) initialize() {
-	handler.newClient(sqs.New(session.New(), &aws.Config{
+func (handler *SQSHandler) Initialize() error {
+	sess := session.New()
+	handler.newClient(sqs.New(sess, &aws.Config{
 		Region:     &handler.awsRegion,
 		MaxRetries: aws.Int(30),
 		HTTPClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
 	}))
+	s3Config := &aws.Config{
+		Region:     &handler.awsRegion,
+		MaxRetries: aws.Int(30),
+	}
+	if handler.s3Endpoint != "" {
+		s3Config.Endpoint = aws.String(handler.s3Endpoint)
+		// Local S3 servers rarely resolve bucket subdomains
+		s3Config.S3ForcePathStyle = aws.Bool(true)
+	}
+	handler.s3 = s3.New(sess, s3Config)
+	return nil
 }
 
 func (handler *SQSHandler) newClient(client sqsiface.SQSAPI) {
 	handler.client = client
+	if handler.buffer != nil {
+		handler.buffer.attach(client)
+	}
+}
+
+// Close releases the buffered messages once the last worker stopped.
+func (handler *SQSHandler) Close() {
+	if handler.buffer != nil {
+		handler.buffer.detach()
+	}
 }
 
-func (handler *SQSHandler) receive() bool {
+func (handler *SQSHandler) Receive() (bool, error) {
+	if handler.buffer != nil {
+		if message := handler.buffer.pop(); message != nil {
+			return handler.setMessage(message), nil
+		}
+	}
 	receiveMessageParams := &sqs.ReceiveMessageInput{
 		QueueUrl:            aws.String(handler.queueURL),
 		MaxNumberOfMessages: aws.Int64(1),
 		WaitTimeSeconds:     aws.Int64(20),
+		// System attributes like ApproximateReceiveCount and SentTimestamp
+		// as well as message attributes are passed to the task
+		AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+	}
+	if handler.fifo {
+		if handler.receiveAttemptID == "" {
+			handler.receiveAttemptID = newTaskID()
+		}
+		receiveMessageParams.ReceiveRequestAttemptId = aws.String(handler.receiveAttemptID)
+	}
+	reserved := 0
+	if handler.buffer != nil {
+		reserved = handler.buffer.reserve() - 1
+		receiveMessageParams.MaxNumberOfMessages = aws.Int64(int64(reserved + 1))
+		// Buffered messages are extended every heartbeat from now on
+		receiveMessageParams.VisibilityTimeout = aws.Int64(int64(handler.visibilityTimeout.Seconds()))
 	}
 	receiveMessageResponse, receiveMessageError := handler.client.ReceiveMessage(receiveMessageParams)
+	if handler.buffer != nil {
+		var running *sqs.Message
+		var extra []*sqs.Message
+		if receiveMessageError == nil && len(receiveMessageResponse.Messages) > 0 {
+			running = receiveMessageResponse.Messages[0]
+			extra = receiveMessageResponse.Messages[1:]
+		}
+		handler.buffer.push(running, extra, reserved)
+	}
 
 	if receiveMessageError != nil {
-		// Print the error, cast err to awserr.Error to get the Code and
-		// Message from an error.
-		log.Println("E: ", receiveMessageError.Error())
-		return false
+		return false, receiveMessageError
 	}
+	handler.receiveAttemptID = ""
 	if len(receiveMessageResponse.Messages) == 0 {
 		log.Println("I: ", "No messages retrieved from queue")
-		return false
+		return false, nil
 	}
 
-	handler.messageBody = *receiveMessageResponse.Messages[0].Body
-	handler.messageID = *receiveMessageResponse.Messages[0].MessageId
-	handler.receiptHandle = *receiveMessageResponse.Messages[0].ReceiptHandle
+	return handler.setMessage(receiveMessageResponse.Messages[0]), nil
+}
 
-	writeFileError := ioutil.WriteFile("payload.json", []byte(handler.messageBody), 0644)
-	if writeFileError != nil {
-		panic(writeFileError)
+func (handler *SQSHandler) setMessage(message *sqs.Message) bool {
+	handler.messageBody = *message.Body
+	handler.messageID = *message.MessageId
+	handler.receiptHandle = *message.ReceiptHandle
+	handler.receiveCount = 1
+	if count, ok := message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]; ok {
+		handler.receiveCount, _ = strconv.Atoi(*count)
+	}
+	handler.attributes = map[string]string{}
+	for name, value := range message.MessageAttributes {
+		if value.StringValue != nil {
+			handler.attributes[name] = *value.StringValue
+		} else if value.BinaryValue != nil {
+			handler.attributes[name] = base64.StdEncoding.EncodeToString(value.BinaryValue)
+		}
+	}
+	// System attributes win over message attributes of the same name
+	for name, value := range message.Attributes {
+		handler.attributes[name] = aws.StringValue(value)
+	}
+	handler.groupID = aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+	handler.sequenceNumber = aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameSequenceNumber])
+	handler.deduplicationID = aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId])
+	handler.rawBody = handler.messageBody
+	handler.payload = nil
+	if pointer, ok := parseS3Pointer(handler.messageBody); ok {
+		if err := handler.download(pointer); err != nil {
+			log.Printf("E: Couldn't read payload %s of message %s %s", pointer, handler.messageID, err.Error())
+			r := result.New()
+			r.SetExit("PAYLOAD")
+			handler.Failure(r)
+			return false
+		}
+		handler.payload = pointer
 	}
 	return true
 }
 
-func (handler *SQSHandler) success() {
+// Attributes are the message's message attributes and system attributes,
+// binary values base64 encoded.
+func (handler *SQSHandler) Attributes() map[string]string {
+	return handler.attributes
+}
+
+// Environment passes the receive count and the FIFO message group and
+// position to the task.
+func (handler *SQSHandler) Environment() map[string]string {
+	return map[string]string{
+		"TASK_RECEIVE_COUNT":    strconv.Itoa(handler.receiveCount),
+		"TASK_MESSAGE_GROUP_ID": handler.groupID,
+		"TASK_SEQUENCE_NUMBER":  handler.sequenceNumber,
+		"TASK_DEDUPLICATION_ID": handler.deduplicationID,
+	}
+}
+
+func (handler *SQSHandler) Success(output *string) {
+	defer handler.finishGroup()
+	if handler.replyQueueURL != "" && output != nil {
+		handler.reply(output)
+	}
+	if handler.buffer != nil {
+		handler.buffer.delete(sqsReceipt{messageID: handler.messageID, receiptHandle: handler.receiptHandle})
+	} else {
+		handler.deleteMessage()
+	}
+	if handler.s3Delete && handler.payload != nil {
+		handler.deletePayload()
+	}
+}
+
+// reply publishes the task's output to the reply queue.
+func (handler *SQSHandler) reply(output *string) {
+	attributes := map[string]*sqs.MessageAttributeValue{
+		"TaskSourceMessageId": stringAttribute(handler.messageID),
+	}
+	body, offloadError := handler.offload(output, attributes)
+	if offloadError != nil {
+		log.Printf("E: Couldn't send output of message %s %s", handler.messageID, offloadError.Error())
+		return
+	}
+	sendMessageParams := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(handler.replyQueueURL),
+		MessageBody:       body,
+		MessageAttributes: attributes,
+	}
+	handler.fifoTarget(handler.replyQueueURL, &sendMessageParams.MessageGroupId, &sendMessageParams.MessageDeduplicationId)
+	_, sendMessageError := handler.client.SendMessage(sendMessageParams)
+
+	if sendMessageError != nil {
+		log.Printf("E: Couldn't send output of message %s %s", handler.messageID, sendMessageError.Error())
+	}
+}
+
+func (handler *SQSHandler) deleteMessage() {
 	deleteMessageParams := &sqs.DeleteMessageInput{
 		QueueUrl:      aws.String(handler.queueURL),
 		ReceiptHandle: aws.String(handler.receiptHandle),
@@ -90,9 +308,129 @@ func (handler *SQSHandler) success() {
 	_, deleteMessageError := handler.client.DeleteMessage(deleteMessageParams)
 
 	if deleteMessageError != nil {
+		log.Printf("E: Couldn't delete message %s %s", handler.messageID, deleteMessageError.Error())
+		return
+	}
+}
+
+func (handler *SQSHandler) Failure(err result.Result) {
+	defer handler.finishGroup()
+	if handler.buffer != nil && handler.groupID != "" {
+		// The group's later messages must not overtake the failed one
+		defer handler.buffer.releaseGroup(handler.groupID)
+	}
+	if err.Exit == "SHUTDOWN" {
+		// The task never ran, so skip the retry backoff and let the next
+		// ReceiveMessage have it. SQS still counts this receive.
+		handler.changeVisibility(0)
 		return
 	}
+	if handler.deadLetterQueueURL != "" && handler.maxAttempts > 0 && handler.receiveCount >= handler.maxAttempts {
+		deadLetterError := handler.deadLetter(err)
+		if deadLetterError == nil {
+			return
+		}
+		log.Printf("E: Couldn't dead letter message %s %s", handler.messageID, deadLetterError.Error())
+	}
+	handler.changeVisibility(handler.backoff())
+}
+
+func (handler *SQSHandler) Heartbeat() {
+	handler.changeVisibility(handler.visibilityTimeout)
+}
+
+func (handler *SQSHandler) backoff() time.Duration {
+	backoff := source.RetryBackoff(handler.retryBackoff, handler.retryBackoffMax, handler.receiveCount)
+	if backoff > maxVisibilityTimeout {
+		backoff = maxVisibilityTimeout
+	}
+	return backoff
+}
+
+func (handler *SQSHandler) changeVisibility(visibility time.Duration) {
+	log.Printf("I: Message %s visible again in %s", handler.messageID, visibility)
+	changeMessageVisibilityParams := &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(handler.queueURL),
+		ReceiptHandle:     aws.String(handler.receiptHandle),
+		VisibilityTimeout: aws.Int64(int64(visibility.Seconds())),
+	}
+	_, changeMessageVisibilityError := handler.client.ChangeMessageVisibility(changeMessageVisibilityParams)
+
+	if changeMessageVisibilityError != nil {
+		log.Printf("E: Couldn't change visibility of message %s %s", handler.messageID, changeMessageVisibilityError.Error())
+	}
 }
 
-func (handler *SQSHandler) failure(err result.Result) {}
-func (handler *SQSHandler) heartbeat()                {}
+// deadLetter sends the message with its failure reason to the dead letter
+// queue and removes it from the source queue.
+func (handler *SQSHandler) deadLetter(err result.Result) error {
+	log.Printf("I: Message %s failed %d times, sending to %s", handler.messageID, handler.receiveCount, handler.deadLetterQueueURL)
+	attributes := map[string]*sqs.MessageAttributeValue{
+		"TaskSourceMessageId": stringAttribute(handler.messageID),
+		"TaskReceiveCount": {
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(handler.receiveCount)),
+		},
+		"TaskErrorMessage": stringAttribute(err.Message()),
+	}
+	// SQS rejects empty attribute values
+	if err.Exit != "" {
+		attributes["TaskExit"] = stringAttribute(err.Exit)
+	}
+	if err.Error != "" {
+		attributes["TaskError"] = stringAttribute(err.Error)
+	}
+	body := aws.String(handler.rawBody)
+	if handler.payload != nil {
+		// The dead letter queue gets the same pointer, the payload stays
+		attributes[s3PayloadSizeAttribute] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(len(handler.messageBody))),
+		}
+	} else {
+		var offloadError error
+		if body, offloadError = handler.offload(body, attributes); offloadError != nil {
+			return offloadError
+		}
+	}
+	sendMessageParams := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(handler.deadLetterQueueURL),
+		MessageBody:       body,
+		MessageAttributes: attributes,
+	}
+	handler.fifoTarget(handler.deadLetterQueueURL, &sendMessageParams.MessageGroupId, &sendMessageParams.MessageDeduplicationId)
+	if _, sendMessageError := handler.client.SendMessage(sendMessageParams); sendMessageError != nil {
+		return sendMessageError
+	}
+	handler.deleteMessage()
+	return nil
+}
+
+func stringAttribute(value string) *sqs.MessageAttributeValue {
+	return &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(value),
+	}
+}
+
+// fifoTarget sets what SendMessage requires for a FIFO queueURL. Messages
+// keep their group, the source message ID deduplicates repeated sends.
+func (handler *SQSHandler) fifoTarget(queueURL string, groupID **string, deduplicationID **string) {
+	if !strings.HasSuffix(queueURL, ".fifo") {
+		return
+	}
+	group := handler.groupID
+	if group == "" {
+		group = handler.messageID
+	}
+	*groupID = aws.String(group)
+	*deduplicationID = aws.String(handler.messageID)
+}
+
+// finishGroup lets the workers start the next buffered message of the
+// current message's group.
+func (handler *SQSHandler) finishGroup() {
+	if handler.buffer != nil && handler.groupID != "" {
+		handler.buffer.finishGroup(handler.groupID)
+	}
+}
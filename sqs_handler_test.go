@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func (client *fakeSQS) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	output := &sqs.ReceiveMessageOutput{}
+	if len(client.messages) > 0 {
+		output.Messages = client.messages[:1]
+		client.messages = client.messages[1:]
+	}
+	return output, nil
+}
+
+func (client *fakeSQS) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.deleted = append(client.deleted, []string{aws.StringValue(input.ReceiptHandle)})
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (client *fakeSQS) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.visibility[aws.StringValue(input.ReceiptHandle)] = aws.Int64Value(input.VisibilityTimeout)
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (client *fakeSQS) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.sendErr != nil {
+		return nil, client.sendErr
+	}
+	client.sent = append(client.sent, input)
+	return &sqs.SendMessageOutput{MessageId: aws.String("sent")}, nil
+}
+
+// newTestSQSHandler receives a message that was received receiveCount times
+// from a fake queue
+func newTestSQSHandler(t *testing.T, receiveCount string) (*SQSHandler, *fakeSQS) {
+	t.Helper()
+	message := testSQSMessage("m1", "")
+	message.Body = aws.String(`{"hello":"world"}`)
+	message.Attributes = map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String(receiveCount)}
+	client := &fakeSQS{visibility: map[string]int64{}, messages: []*sqs.Message{message}}
+	handler := &SQSHandler{
+		queueURL:           "https://sqs.us-west-2.amazonaws.com/123456789012/tasks",
+		visibilityTimeout:  5 * time.Minute,
+		retryBackoff:       30 * time.Second,
+		retryBackoffMax:    24 * time.Hour,
+		maxAttempts:        3,
+		deadLetterQueueURL: "https://sqs.us-west-2.amazonaws.com/123456789012/tasks-dead",
+	}
+	handler.newClient(client)
+	if received, err := handler.Receive(); !received || err != nil {
+		t.Fatalf("Receive() = %t, %v, want the message", received, err)
+	}
+	return handler, client
+}
+
+func testFailure(exit string) result.Result {
+	r := result.New()
+	r.SetExit(exit)
+	return r
+}
+
+func TestSQSFailureBacksOff(t *testing.T) {
+	tests := []struct {
+		receiveCount string
+		want         int64
+	}{
+		{"1", 30},
+		{"2", 60},
+		// SQS takes at most 12 hours
+		{"20", int64(maxVisibilityTimeout.Seconds())},
+	}
+	for _, test := range tests {
+		handler, client := newTestSQSHandler(t, test.receiveCount)
+		handler.deadLetterQueueURL = ""
+		handler.Failure(testFailure("1"))
+		if visibility, ok := client.visibility["m1"]; !ok || visibility != test.want {
+			t.Errorf("receive %s: visibility = %d, %t, want %d", test.receiveCount, visibility, ok, test.want)
+		}
+		if len(client.sent) != 0 || len(client.deleted) != 0 {
+			t.Errorf("receive %s: sent %d, deleted %v, want the message left in the queue", test.receiveCount, len(client.sent), client.deleted)
+		}
+	}
+}
+
+func TestSQSFailureReleasesOnShutdown(t *testing.T) {
+	// Even the last attempt isn't dead lettered, the task never failed
+	handler, client := newTestSQSHandler(t, "3")
+	handler.Failure(testFailure("SHUTDOWN"))
+	if visibility, ok := client.visibility["m1"]; !ok || visibility != 0 {
+		t.Errorf("visibility = %d, %t, want 0", visibility, ok)
+	}
+	if len(client.sent) != 0 {
+		t.Errorf("sent %d messages, want none", len(client.sent))
+	}
+}
+
+func TestSQSFailureDeadLettersAfterMaxAttempts(t *testing.T) {
+	handler, client := newTestSQSHandler(t, "2")
+	handler.Failure(testFailure("1"))
+	if len(client.sent) != 0 {
+		t.Fatalf("dead lettered on receive 2 of 3")
+	}
+
+	handler, client = newTestSQSHandler(t, "3")
+	failure := testFailure("1")
+	failure.Error = "boom"
+	handler.Failure(failure)
+	if len(client.sent) != 1 {
+		t.Fatalf("sent %d messages, want the dead letter", len(client.sent))
+	}
+	sent := client.sent[0]
+	if aws.StringValue(sent.QueueUrl) != handler.deadLetterQueueURL || aws.StringValue(sent.MessageBody) != `{"hello":"world"}` {
+		t.Errorf("sent %s to %s, want the body to the dead letter queue", aws.StringValue(sent.MessageBody), aws.StringValue(sent.QueueUrl))
+	}
+	for name, want := range map[string]string{
+		"TaskSourceMessageId": "m1",
+		"TaskReceiveCount":    "3",
+		"TaskExit":            "1",
+		"TaskError":           "boom",
+		"TaskErrorMessage":    failure.Message(),
+	} {
+		if attribute, ok := sent.MessageAttributes[name]; !ok || aws.StringValue(attribute.StringValue) != want {
+			t.Errorf("attribute %s = %v, want %q", name, attribute, want)
+		}
+	}
+	if len(client.deleted) != 1 || client.deleted[0][0] != "m1" {
+		t.Errorf("deleted %v, want the dead lettered message", client.deleted)
+	}
+	if _, ok := client.visibility["m1"]; ok {
+		t.Error("changed the visibility of a dead lettered message")
+	}
+}
+
+func TestSQSFailureBacksOffWhenDeadLetterFails(t *testing.T) {
+	handler, client := newTestSQSHandler(t, "3")
+	client.sendErr = errors.New("AccessDenied")
+	handler.Failure(testFailure("1"))
+	if len(client.deleted) != 0 {
+		t.Errorf("deleted %v, want the message kept", client.deleted)
+	}
+	if visibility := client.visibility["m1"]; visibility != 120 {
+		t.Errorf("visibility = %d, want the backoff of receive 3", visibility)
+	}
+}
+
+func TestSQSHeartbeatExtendsVisibility(t *testing.T) {
+	handler, client := newTestSQSHandler(t, "1")
+	handler.Heartbeat()
+	if visibility, ok := client.visibility["m1"]; !ok || visibility != 300 {
+		t.Errorf("visibility = %d, %t, want TASK_VISIBILITY_TIMEOUT", visibility, ok)
+	}
+	// Every heartbeat extends it again from now
+	client.visibility["m1"] = 0
+	handler.Heartbeat()
+	if visibility := client.visibility["m1"]; visibility != 300 {
+		t.Errorf("visibility = %d after the second heartbeat, want TASK_VISIBILITY_TIMEOUT", visibility)
+	}
+	if len(client.deleted) != 0 || len(client.sent) != 0 {
+		t.Errorf("deleted %v, sent %d while heartbeating", client.deleted, len(client.sent))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// sqsMaxMessageSize is the largest message SQS accepts, body and message
+// attributes together.
+const sqsMaxMessageSize = 256 * 1024
+
+// Pointer classes of the SQS extended clients. Messages are offloaded with
+// the current one, both are received.
+const (
+	s3PointerClass       = "software.amazon.payloadoffloading.PayloadS3Pointer"
+	s3PointerClassLegacy = "com.amazon.sqs.javamessaging.MessageS3Pointer"
+)
+
+// s3PayloadSizeAttribute is the attribute the extended clients mark an
+// offloaded message with.
+const s3PayloadSizeAttribute = "ExtendedPayloadSize"
+
+// s3Pointer locates a payload stored in S3 instead of the message body.
+type s3Pointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// parseS3Pointer recognizes the extended client format,
+// ["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":...,"s3Key":...}],
+// and a body that is only {"s3Ref":"s3://bucket/key"}.
+func parseS3Pointer(body string) (*s3Pointer, bool) {
+	body = strings.TrimSpace(body)
+	switch {
+	case strings.HasPrefix(body, "["):
+		var parts []json.RawMessage
+		if json.Unmarshal([]byte(body), &parts) != nil || len(parts) != 2 {
+			return nil, false
+		}
+		var class string
+		if json.Unmarshal(parts[0], &class) != nil || (class != s3PointerClass && class != s3PointerClassLegacy) {
+			return nil, false
+		}
+		pointer := &s3Pointer{}
+		if json.Unmarshal(parts[1], pointer) != nil || pointer.Bucket == "" || pointer.Key == "" {
+			return nil, false
+		}
+		return pointer, true
+	case strings.HasPrefix(body, "{"):
+		var fields map[string]string
+		if json.Unmarshal([]byte(body), &fields) != nil || len(fields) != 1 {
+			return nil, false
+		}
+		ref, ok := fields["s3Ref"]
+		if !ok || !strings.HasPrefix(ref, "s3://") {
+			return nil, false
+		}
+		location := strings.SplitN(strings.TrimPrefix(ref, "s3://"), "/", 2)
+		if len(location) != 2 || location[0] == "" || location[1] == "" {
+			return nil, false
+		}
+		return &s3Pointer{Bucket: location[0], Key: location[1]}, true
+	}
+	return nil, false
+}
+
+func (pointer *s3Pointer) String() string {
+	return fmt.Sprintf("s3://%s/%s", pointer.Bucket, pointer.Key)
+}
+
+// download replaces a pointer body with the payload it points to.
+func (handler *SQSHandler) download(pointer *s3Pointer) error {
+	object, err := handler.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(pointer.Bucket),
+		Key:    aws.String(pointer.Key),
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+	body, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return err
+	}
+	log.Printf("I: Message %s payload read from %s", handler.messageID, pointer)
+	handler.messageBody = string(body)
+	return nil
+}
+
+// deletePayload removes the S3 payload of a succeeded message.
+func (handler *SQSHandler) deletePayload() {
+	_, err := handler.s3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(handler.payload.Bucket),
+		Key:    aws.String(handler.payload.Key),
+	})
+	if err != nil {
+		log.Printf("E: Couldn't delete payload %s of message %s %s", handler.payload, handler.messageID, err.Error())
+	}
+}
+
+// offload stores a body too large for SQS in s3Bucket and returns the
+// pointer to send instead. Bodies that fit are returned unchanged.
+func (handler *SQSHandler) offload(body *string, attributes map[string]*sqs.MessageAttributeValue) (*string, error) {
+	size := messageSize(*body, attributes)
+	if size <= sqsMaxMessageSize {
+		return body, nil
+	}
+	if handler.s3Bucket == "" {
+		return nil, fmt.Errorf("message of %d bytes exceeds the SQS limit, set TASK_SQS_S3_BUCKET", size)
+	}
+	pointer := &s3Pointer{Bucket: handler.s3Bucket, Key: newTaskID()}
+	_, err := handler.s3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(pointer.Bucket),
+		Key:    aws.String(pointer.Key),
+		Body:   bytes.NewReader([]byte(*body)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("I: Message of %d bytes stored in %s", size, pointer)
+	attributes[s3PayloadSizeAttribute] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(len(*body))),
+	}
+	encoded, err := json.Marshal([]interface{}{s3PointerClass, pointer})
+	if err != nil {
+		return nil, err
+	}
+	return aws.String(string(encoded)), nil
+}
+
+// messageSize counts a message the way SQS does against its size limit.
+func messageSize(body string, attributes map[string]*sqs.MessageAttributeValue) int {
+	size := len(body)
+	for name, value := range attributes {
+		size += len(name) + len(aws.StringValue(value.DataType)) + len(aws.StringValue(value.StringValue)) + len(value.BinaryValue)
+	}
+	return size
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestParseS3Pointer(t *testing.T) {
+	tests := []struct {
+		body string
+		want *s3Pointer
+	}{
+		{`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"payloads","s3Key":"a/b"}]`, &s3Pointer{"payloads", "a/b"}},
+		{`  ["com.amazon.sqs.javamessaging.MessageS3Pointer",{"s3BucketName":"payloads","s3Key":"c"}]`, &s3Pointer{"payloads", "c"}},
+		{`{"s3Ref":"s3://payloads/a/b"}`, &s3Pointer{"payloads", "a/b"}},
+		// Not pointers, or malformed ones, are passed on as the payload
+		{`{"hello":"world"}`, nil},
+		{`["some.other.Class",{"s3BucketName":"payloads","s3Key":"c"}]`, nil},
+		{`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"payloads"}]`, nil},
+		{`["software.amazon.payloadoffloading.PayloadS3Pointer"]`, nil},
+		{`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"payloads","s3Key":"c"},1]`, nil},
+		{`[1,2]`, nil},
+		{`{"s3Ref":"https://payloads/a"}`, nil},
+		{`{"s3Ref":"s3://payloads"}`, nil},
+		{`{"s3Ref":"s3:///a"}`, nil},
+		{`{"s3Ref":"s3://payloads/a","more":"fields"}`, nil},
+		{`{"s3Ref":1}`, nil},
+		{`s3://payloads/a`, nil},
+		{``, nil},
+	}
+	for _, test := range tests {
+		pointer, ok := parseS3Pointer(test.body)
+		if ok != (test.want != nil) || (ok && *pointer != *test.want) {
+			t.Errorf("parseS3Pointer(%s) = %v, %t, want %v", test.body, pointer, ok, test.want)
+		}
+	}
+}
+
+func TestOffloadThreshold(t *testing.T) {
+	handler := &SQSHandler{}
+	body := strings.Repeat("x", sqsMaxMessageSize)
+	sent, err := handler.offload(&body, map[string]*sqs.MessageAttributeValue{})
+	if err != nil || sent != &body {
+		t.Errorf("offload() of %d bytes = %v, want the body unchanged", len(body), err)
+	}
+	// Attributes count toward the limit
+	attributes := map[string]*sqs.MessageAttributeValue{
+		"TaskExit": {DataType: aws.String("String"), StringValue: aws.String("1")},
+	}
+	if _, err := handler.offload(&body, attributes); err == nil || !strings.Contains(err.Error(), "TASK_SQS_S3_BUCKET") {
+		t.Errorf("offload() over the limit without a bucket = %v, want an error naming TASK_SQS_S3_BUCKET", err)
+	}
+}
+
+// s3Stub is an in-memory S3 serving path style requests
+type s3Stub struct {
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func (stub *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		stub.objects[r.URL.Path] = string(body)
+	case http.MethodGet:
+		body, ok := stub.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		w.Write([]byte(body))
+	case http.MethodDelete:
+		delete(stub.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestOffloadAndDownload(t *testing.T) {
+	stub := &s3Stub{objects: map[string]string{}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-west-2"),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &SQSHandler{s3: s3.New(sess), s3Bucket: "payloads"}
+
+	body := strings.Repeat("x", sqsMaxMessageSize+1)
+	attributes := map[string]*sqs.MessageAttributeValue{}
+	sent, err := handler.offload(&body, attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pointer, ok := parseS3Pointer(*sent)
+	if !ok || pointer.Bucket != "payloads" {
+		t.Fatalf("offload() sent %s, want a pointer into payloads", *sent)
+	}
+	if size := attributes[s3PayloadSizeAttribute]; size == nil || *size.StringValue != "262145" {
+		t.Errorf("%s = %v, want 262145", s3PayloadSizeAttribute, size)
+	}
+	if len(stub.objects) != 1 {
+		t.Fatalf("stored %d objects, want 1", len(stub.objects))
+	}
+
+	if err := handler.download(pointer); err != nil {
+		t.Fatal(err)
+	}
+	if handler.messageBody != body {
+		t.Errorf("downloaded %d bytes, want the %d offloaded", len(handler.messageBody), len(body))
+	}
+	handler.payload = pointer
+	handler.deletePayload()
+	if len(stub.objects) != 0 {
+		t.Errorf("objects = %v after deletePayload, want none", stub.objects)
+	}
+	if err := handler.download(pointer); err == nil {
+		t.Error("download() of a deleted payload = nil, want an error")
+	}
+}
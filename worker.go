@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
+)
+
+const (
+	// receiveRetryBackoff is the wait after a failed receive, doubled for
+	// every further failure up to receiveRetryBackoffMax
+	receiveRetryBackoff    = time.Second
+	receiveRetryBackoffMax = time.Minute
+)
+
+// worker drains messages from its own handler and runs them on its own
+// executable. Handlers and executables keep per-message state, so they are
+// never shared between workers.
+type worker struct {
+	id         int
+	handler    source.MessageHandler
+	executable ExecutableInterface
+}
+
+// runWorkers starts tasque.Concurrency workers and blocks until all of them
+// have stopped. SIGTERM or SIGINT stops them from receiving new work and lets
+// in-flight tasks drain, a second one exits without waiting for them. The
+// error is the first handler that couldn't be initialized, before any worker
+// started, or the first receive error of a one-shot worker.
+func (tasque *Tasque) runWorkers() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("I: Received %s, shutting down", sig)
+			cancel()
+		case <-stopped:
+			return
+		}
+		select {
+		case sig := <-signals:
+			log.Fatalf("E: Received %s again, exiting without waiting for tasks", sig)
+		case <-stopped:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var err error
+	workers := make([]*worker, tasque.Concurrency)
+	for i := range workers {
+		w := &worker{
+			id:         i,
+			handler:    tasque.getHandler(),
+			executable: tasque.NewExecutable(i),
+		}
+		if contextHandler, ok := w.handler.(source.ContextHandler); ok {
+			contextHandler.SetContext(ctx)
+		}
+		if initErr := w.handler.Initialize(); initErr != nil {
+			return fmt.Errorf("initialize: %w", initErr)
+		}
+		workers[i] = w
+	}
+	log.Printf("I: Starting %d workers (max messages: %d)", tasque.Concurrency, tasque.MaxMessages)
+	for _, w := range workers {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if workErr := tasque.work(ctx, w); workErr != nil {
+				errOnce.Do(func() { err = workErr })
+			}
+		}()
+	}
+	wg.Wait()
+	log.Printf("I: All workers stopped after %d messages", atomic.LoadInt64(&tasque.processed))
+	return err
+}
+
+// work loops receive -> execute on an initialized worker until the message
+// budget is spent. Outside of daemon mode a single empty receive ends the worker, which is
+// the original one-shot behaviour, in daemon mode only an exhausted
+// source.FiniteHandler does. A receive error is returned outside of daemon
+// mode and retried with backoff in it.
+func (tasque *Tasque) work(ctx context.Context, w *worker) error {
+	var err error
+	failures := 0
+	for ctx.Err() == nil && tasque.claim() {
+		received, receiveErr := w.handler.Receive()
+		if receiveErr != nil {
+			tasque.unclaim()
+			if !tasque.Daemon {
+				err = fmt.Errorf("receive: %w", receiveErr)
+				break
+			}
+			failures++
+			backoff := source.RetryBackoff(receiveRetryBackoff, receiveRetryBackoffMax, failures)
+			log.Printf("E: Worker %d couldn't receive, retrying in %s %s", w.id, backoff, receiveErr.Error())
+			source.Sleep(ctx, backoff)
+			continue
+		}
+		failures = 0
+		if !received {
+			tasque.unclaim()
+			if !tasque.Daemon || exhausted(w.handler) {
+				break
+			}
+			continue
+		}
+		log.Printf("I: Worker %d received message %s", w.id, *w.handler.ID())
+		if ctx.Err() != nil {
+			// The receive outlived the shutdown, hand the message back
+			// without starting it
+			log.Printf("I: Worker %d releasing message %s", w.id, *w.handler.ID())
+			r := result.New()
+			r.SetExit("SHUTDOWN")
+			w.handler.Failure(r)
+			break
+		}
+		atomic.AddInt64(&tasque.processed, 1)
+		w.execute(ctx)
+	}
+	if closable, ok := w.handler.(source.ClosableHandler); ok {
+		closable.Close()
+	}
+	log.Printf("I: Worker %d finished", w.id)
+	return err
+}
+
+// execute runs the current message, stopping its task early when the
+// handler abandons it.
+func (w *worker) execute(ctx context.Context) {
+	taskCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if abandonable, ok := w.handler.(source.AbandonableHandler); ok {
+		abandoned := abandonable.Abandoned()
+		go func() {
+			select {
+			case <-abandoned:
+				log.Printf("I: Worker %d stopping abandoned message %s", w.id, *w.handler.ID())
+				cancel()
+			case <-taskCtx.Done():
+			}
+		}()
+	}
+	w.executable.Execute(taskCtx, w.handler)
+}
+
+func exhausted(handler source.MessageHandler) bool {
+	finite, ok := handler.(source.FiniteHandler)
+	return ok && finite.Exhausted()
+}
+
+// abandoned tells a task stopped because its handler gave up on the message
+// from one stopped by a shutdown.
+func abandoned(handler source.MessageHandler) bool {
+	abandonable, ok := handler.(source.AbandonableHandler)
+	if !ok {
+		return false
+	}
+	select {
+	case <-abandonable.Abandoned():
+		return true
+	default:
+		return false
+	}
+}
+
+// claim reserves one message from the TASK_MAX_MESSAGES budget before a
+// receive, so concurrent workers can never overshoot it. A zero budget is
+// unlimited.
+func (tasque *Tasque) claim() bool {
+	if tasque.MaxMessages <= 0 {
+		return true
+	}
+	if atomic.AddInt64(&tasque.claimed, 1) > int64(tasque.MaxMessages) {
+		atomic.AddInt64(&tasque.claimed, -1)
+		return false
+	}
+	return true
+}
+
+// unclaim gives a reservation back when the receive came up empty.
+func (tasque *Tasque) unclaim() {
+	if tasque.MaxMessages > 0 {
+		atomic.AddInt64(&tasque.claimed, -1)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Skycatch/tasque-go/result"
+	"github.com/Skycatch/tasque-go/source"
+)
+
+// receive is one scripted Receive outcome of a fakeHandler
+type receive struct {
+	received bool
+	err      error
+}
+
+type fakeHandler struct {
+	receives  []receive
+	failures  []string
+	successes int
+	onReceive func()
+}
+
+func (handler *fakeHandler) ID() *string {
+	id := "fake"
+	return &id
+}
+func (handler *fakeHandler) Body() *string                 { return new(string) }
+func (handler *fakeHandler) Attributes() map[string]string { return nil }
+func (handler *fakeHandler) Initialize() error             { return nil }
+func (handler *fakeHandler) Heartbeat()                    {}
+
+func (handler *fakeHandler) Receive() (bool, error) {
+	if handler.onReceive != nil {
+		handler.onReceive()
+	}
+	if len(handler.receives) == 0 {
+		return false, nil
+	}
+	next := handler.receives[0]
+	handler.receives = handler.receives[1:]
+	return next.received, next.err
+}
+
+func (handler *fakeHandler) Success(output *string) { handler.successes++ }
+
+func (handler *fakeHandler) Failure(err result.Result) {
+	handler.failures = append(handler.failures, err.Exit)
+}
+
+type fakeExecutable struct {
+	runs int
+}
+
+func (executable *fakeExecutable) Execute(ctx context.Context, handler source.MessageHandler) {
+	executable.runs++
+	handler.Success(nil)
+}
+
+func (executable *fakeExecutable) Result() result.Result { return result.New() }
+
+func TestWorkReturnsReceiveErrorOutsideDaemonMode(t *testing.T) {
+	receiveErr := errors.New("queue does not exist")
+	handler := &fakeHandler{receives: []receive{{err: receiveErr}}}
+	executable := &fakeExecutable{}
+	tasque := &Tasque{Concurrency: 1, MaxMessages: 1}
+
+	err := tasque.work(context.Background(), &worker{handler: handler, executable: executable})
+	if !errors.Is(err, receiveErr) {
+		t.Fatalf("work() = %v, want %v", err, receiveErr)
+	}
+	if executable.runs != 0 {
+		t.Errorf("ran %d tasks, want 0", executable.runs)
+	}
+	if tasque.claimed != 0 {
+		t.Errorf("claimed = %d after a failed receive, want 0", tasque.claimed)
+	}
+}
+
+func TestWorkStopsBackingOffOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := &fakeHandler{
+		receives:  []receive{{err: errors.New("connection refused")}},
+		onReceive: cancel,
+	}
+	tasque := &Tasque{Concurrency: 1, Daemon: true}
+
+	if err := tasque.work(ctx, &worker{handler: handler, executable: &fakeExecutable{}}); err != nil {
+		t.Fatalf("work() = %v, want nil in daemon mode", err)
+	}
+}
+
+func TestWorkReleasesMessagesReceivedDuringShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := &fakeHandler{
+		receives:  []receive{{received: true}},
+		onReceive: cancel,
+	}
+	executable := &fakeExecutable{}
+	tasque := &Tasque{Concurrency: 1, Daemon: true}
+
+	if err := tasque.work(ctx, &worker{handler: handler, executable: executable}); err != nil {
+		t.Fatal(err)
+	}
+	if executable.runs != 0 {
+		t.Errorf("ran %d tasks, want 0", executable.runs)
+	}
+	if len(handler.failures) != 1 || handler.failures[0] != "SHUTDOWN" {
+		t.Errorf("failures = %v, want [SHUTDOWN]", handler.failures)
+	}
+	if tasque.processed != 0 {
+		t.Errorf("processed = %d, want 0 for a released message", tasque.processed)
+	}
+}
+
+func TestWorkRunsMessagesUntilBudgetSpent(t *testing.T) {
+	handler := &fakeHandler{receives: []receive{{received: true}, {received: true}, {received: true}}}
+	executable := &fakeExecutable{}
+	tasque := &Tasque{Concurrency: 1, MaxMessages: 2, Daemon: true}
+
+	if err := tasque.work(context.Background(), &worker{handler: handler, executable: executable}); err != nil {
+		t.Fatal(err)
+	}
+	if executable.runs != 2 || handler.successes != 2 || tasque.processed != 2 {
+		t.Errorf("runs, successes, processed = %d, %d, %d, want 2 each", executable.runs, handler.successes, tasque.processed)
+	}
+}